@@ -0,0 +1,323 @@
+package app
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// limits of a user or pool, nil limits and storages or devices missing from the maps are unlimited
+type Quota struct {
+	Instances *uint64           `json:"instances"`
+	Cores     *uint64           `json:"cores"`
+	Memory    *uint64           `json:"memory"`  // bytes
+	Swap      *uint64           `json:"swap"`    // bytes
+	Network   *uint64           `json:"network"` // sum of net rate limits
+	Disk      map[string]uint64 `json:"disk"`    // bytes per storage
+	Devices   map[string]uint64 `json:"devices"` // pci devices per device name
+}
+
+// limits applied when admitting requests
+type AdmissionPolicy struct {
+	Quotas     QuotaConfig
+	Overcommit OvercommitConfig
+}
+
+type QuotaConfig struct {
+	Default *Quota            `json:"default"` // applied to users without their own quota
+	Users   map[string]*Quota `json:"users"`
+	Pools   map[string]*Quota `json:"pools"`
+}
+
+// a proposed new instance, or a resize of an existing instance
+type AdmissionRequest struct {
+	User    string            `json:"user"`
+	Pool    string            `json:"pool"`  // defaults to the pool of the existing instance
+	Node    string            `json:"node"`  // defaults to the node of the existing instance
+	VMID    InstanceID        `json:"vmid"`  // existing instance being resized, 0 for a new instance
+	Delta   bool              `json:"delta"` // resources are increments to the existing instance instead of its proposed total
+	Cores   int64             `json:"cores"`
+	Memory  int64             `json:"memory"`
+	Swap    int64             `json:"swap"`
+	Volumes []AdmissionVolume `json:"volumes"`
+	Nets    []AdmissionNet    `json:"nets"`
+	Devices []AdmissionDevice `json:"devices"`
+}
+
+type AdmissionVolume struct {
+	Storage string `json:"storage"`
+	Size    int64  `json:"size"`
+}
+
+type AdmissionNet struct {
+	Rate int64 `json:"rate"`
+}
+
+type AdmissionDevice struct {
+	Device_Name string `json:"device_name"`
+	Count       int64  `json:"count"` // defaults to 1
+}
+
+// the signed change in resources a request would cause
+type Demand struct {
+	Instances int64
+	Cores     int64
+	Memory    int64
+	Swap      int64
+	Network   int64
+	Disk      map[string]int64
+	Devices   map[string]int64
+}
+
+// the result of checking a single resource against a single limit
+type AdmissionCheck struct {
+	Resource  string `json:"resource"` // eg: cores, memory, disk:local-lvm, device:GA102GL [A40]
+	Scope     string `json:"scope"`    // eg: user alice@pve, pool students, node pve1
+	Requested int64  `json:"requested"`
+	Used      uint64 `json:"used"`
+	Limit     uint64 `json:"limit"`
+	Allowed   bool   `json:"allowed"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+type AdmissionResult struct {
+	Allowed bool             `json:"allowed"`
+	Checks  []AdmissionCheck `json:"checks"`
+}
+
+func NewDemand() Demand {
+	return Demand{
+		Disk:    make(map[string]int64),
+		Devices: make(map[string]int64),
+	}
+}
+
+// get the resources requested by a spec
+func (request *AdmissionRequest) Demand() Demand {
+	demand := NewDemand()
+	demand.Cores = request.Cores
+	demand.Memory = request.Memory
+	demand.Swap = request.Swap
+	for _, volume := range request.Volumes {
+		demand.Disk[volume.Storage] += volume.Size
+	}
+	for _, net := range request.Nets {
+		demand.Network += net.Rate
+	}
+	for _, device := range request.Devices {
+		count := device.Count
+		if count == 0 {
+			count = 1
+		}
+		demand.Devices[device.Device_Name] += count
+	}
+	return demand
+}
+
+// removes the resources currently allocated to an instance
+func (demand Demand) Release(instance *Instance) Demand {
+	usage := Usage{Disk: make(map[string]uint64), Devices: make(map[string]int)}
+	usage.Add(0, instance)
+	demand.Cores -= int64(usage.Cores)
+	demand.Memory -= int64(usage.Memory)
+	demand.Swap -= int64(usage.Swap)
+	demand.Network -= int64(usage.Network)
+	demand.Disk = maps.Clone(demand.Disk)
+	for storage, size := range usage.Disk {
+		demand.Disk[storage] -= int64(size)
+	}
+	demand.Devices = maps.Clone(demand.Devices)
+	for name, count := range usage.Devices {
+		demand.Devices[name] -= int64(count)
+	}
+	return demand
+}
+
+// checks a proposed instance or resize against the quotas of its user and pool and the capacity of its node
+//
+// pending reservations count as used
+func (snapshot *Snapshot) Admit(request AdmissionRequest, policy AdmissionPolicy, pending []*Reservation) (*AdmissionResult, error) {
+	demand := request.Demand()
+	nodeDemand := demand
+
+	if request.VMID != 0 {
+		hostName, ok := snapshot.Locate(uint(request.VMID))
+		if !ok {
+			return nil, fmt.Errorf("vmid %d not in cluster", request.VMID)
+		}
+		instance := snapshot.Nodes[hostName].Instances[request.VMID]
+		if request.Node == "" {
+			request.Node = hostName
+		}
+		if request.Pool == "" {
+			request.Pool = instance.Pool
+		}
+		if !request.Delta {
+			demand = demand.Release(instance)
+			if request.Node == hostName { // moving to another node needs the full spec on that node
+				nodeDemand = demand
+			}
+		}
+	} else if request.Delta {
+		return nil, fmt.Errorf("delta requires the vmid of an existing instance")
+	} else {
+		demand.Instances = 1
+	}
+
+	checks, err := snapshot.AdmitDemand(request.User, request.Pool, request.Node, demand, nodeDemand, policy, pending)
+	if err != nil {
+		return nil, err
+	}
+	return NewAdmissionResult(checks), nil
+}
+
+// checks a demand against the quotas of a user and pool, and a node demand against the capacity of a node, empty names are not checked
+func (snapshot *Snapshot) AdmitDemand(userName string, poolName string, hostName string, demand Demand, nodeDemand Demand, policy AdmissionPolicy, pending []*Reservation) ([]AdmissionCheck, error) {
+	checks := []AdmissionCheck{}
+
+	if userName != "" {
+		quota, ok := policy.Quotas.Users[userName]
+		if !ok {
+			quota = policy.Quotas.Default
+		}
+		if quota != nil {
+			used, err := snapshot.UserUsage(userName)
+			if err != nil { // user has not been synced from the ACL yet, or the ACL can not be read, so it owns nothing the model knows about
+				used = snapshot.Usage(func(InstanceID, *Instance) bool { return false })
+			}
+			for _, reservation := range pending {
+				if reservation.User == userName {
+					used.AddReservation(reservation)
+				}
+			}
+			checks = append(checks, quota.Check("user "+userName, used, demand)...)
+		}
+	}
+
+	if poolName != "" {
+		if quota, ok := policy.Quotas.Pools[poolName]; ok {
+			used, err := snapshot.PoolUsage(poolName)
+			if err != nil {
+				return nil, err
+			}
+			for _, reservation := range pending {
+				if reservation.Pool == poolName {
+					used.AddReservation(reservation)
+				}
+			}
+			checks = append(checks, quota.Check("pool "+poolName, used, demand)...)
+		}
+	}
+
+	if hostName != "" {
+		host, err := snapshot.GetNode(hostName)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, snapshot.CheckNode(host, nodeDemand, pending, policy.Overcommit)...)
+	}
+
+	return checks, nil
+}
+
+// the request is allowed if every check is allowed
+func NewAdmissionResult(checks []AdmissionCheck) *AdmissionResult {
+	result := AdmissionResult{Allowed: true, Checks: checks}
+	for _, check := range checks {
+		result.Allowed = result.Allowed && check.Allowed
+	}
+	return &result
+}
+
+// checks a demand against each limit of a quota
+func (quota *Quota) Check(scope string, used *Usage, demand Demand) []AdmissionCheck {
+	checks := []AdmissionCheck{}
+	limits := []struct {
+		resource string
+		limit    *uint64
+		used     uint64
+		demand   int64
+	}{
+		{"instances", quota.Instances, uint64(len(used.Instances)), demand.Instances},
+		{"cores", quota.Cores, used.Cores, demand.Cores},
+		{"memory", quota.Memory, used.Memory, demand.Memory},
+		{"swap", quota.Swap, used.Swap, demand.Swap},
+		{"network", quota.Network, used.Network, demand.Network},
+	}
+	for _, limit := range limits {
+		if limit.limit != nil {
+			checks = append(checks, Check(limit.resource, scope, limit.demand, limit.used, *limit.limit))
+		}
+	}
+	for _, storage := range slices.Sorted(maps.Keys(quota.Disk)) {
+		checks = append(checks, Check("disk:"+storage, scope, demand.Disk[storage], used.Disk[storage], quota.Disk[storage]))
+	}
+	for _, name := range slices.Sorted(maps.Keys(quota.Devices)) {
+		checks = append(checks, Check("device:"+name, scope, demand.Devices[name], uint64(used.Devices[name]), quota.Devices[name]))
+	}
+	return checks
+}
+
+// checks a demand against the live capacity of a node within its overcommit limits, pending reservations on the node count as used
+func (snapshot *Snapshot) CheckNode(host *Node, demand Demand, pending []*Reservation, overcommit OvercommitConfig) []AdmissionCheck {
+	scope := "node " + host.Name
+	if host.Status != NodeOnline {
+		return []AdmissionCheck{{Resource: "node", Scope: scope, Allowed: false, Reason: fmt.Sprintf("%s is %s", scope, host.Status)}}
+	}
+
+	capacity := snapshot.NodeCapacity(host, pending, overcommit)
+	held := PendingDevices(host.Name, pending)
+	checks := []AdmissionCheck{
+		Check("cores", scope, demand.Cores, capacity.Cores.Allocated+capacity.Cores.Reserved, capacity.Cores.Budget),
+		Check("memory", scope, demand.Memory, capacity.Memory.Allocated+capacity.Memory.Reserved, capacity.Memory.Budget),
+		Check("swap", scope, demand.Swap, capacity.Swap.Allocated+capacity.Swap.Reserved, capacity.Swap.Budget),
+	}
+
+	for _, storageName := range slices.Sorted(maps.Keys(demand.Disk)) {
+		resource := "disk:" + storageName
+		storage, ok := host.Storages[storageName]
+		if !ok || !storage.Active {
+			check := AdmissionCheck{Resource: resource, Scope: scope, Requested: demand.Disk[storageName], Allowed: demand.Disk[storageName] <= 0}
+			if !check.Allowed {
+				check.Reason = fmt.Sprintf("%s has no active storage %s", scope, storageName)
+			}
+			checks = append(checks, check)
+			continue
+		}
+		// storage usage is live so only pending reservations are added to it
+		checks = append(checks, Check(resource, scope, demand.Disk[storageName], storage.Used+capacity.Storages[storageName].Reserved, storage.Size))
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(demand.Devices)) {
+		total := uint64(0)
+		reserved := uint64(0)
+		for _, device := range host.Devices {
+			if device.Device_Name == name {
+				total++
+				if !host.DeviceFree(device, held) {
+					reserved++
+				}
+			}
+		}
+		checks = append(checks, Check("device:"+name, scope, demand.Devices[name], reserved, total))
+	}
+
+	return checks
+}
+
+// checks if adding demand to used stays within limit, decreases are always allowed
+func Check(resource string, scope string, demand int64, used uint64, limit uint64) AdmissionCheck {
+	check := AdmissionCheck{
+		Resource:  resource,
+		Scope:     scope,
+		Requested: demand,
+		Used:      used,
+		Limit:     limit,
+		Allowed:   true,
+	}
+	if demand > 0 && used+uint64(demand) > limit {
+		check.Allowed = false
+		check.Reason = fmt.Sprintf("%s %s would be %d of %d", scope, resource, used+uint64(demand), limit)
+	}
+	return check
+}
@@ -1,21 +1,26 @@
 package app
 
 import (
+	"context"
 	"encoding/gob"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	"github.com/luthermonson/go-proxmox"
 )
 
 const APIVersion string = "1.0.0"
 
 var client ProxmoxClient
+var cluster Cluster
 
 func Run() {
 	gob.Register(proxmox.Client{})
@@ -32,33 +37,103 @@ func Run() {
 
 	router := gin.Default()
 
-	cluster := Cluster{}
-	cluster.Init(client)
-	start := time.Now()
-	log.Printf("Starting cluster sync\n")
-	cluster.Sync()
-	log.Printf("Synced cluster in %fs\n", time.Since(start).Seconds())
+	events := NewEventBus()
+	if len(config.Webhooks) > 0 {
+		webhooks := NewWebhookDispatcher(config.Webhooks, config.WebhookDeadLetter)
+		events.AddHandler(webhooks.Enqueue)
+		log.Printf("Initialized %d webhook targets", len(config.Webhooks))
+	}
+
+	cluster = Cluster{}
+	cluster.Init(client, NewScheduler(config.SyncConcurrency, config.SyncNodeConcurrency))
+	cluster.AddListener(events.Publish)
+
+	policy := AdmissionPolicy{Quotas: config.Quotas, Overcommit: config.Overcommit}
+	reservations := NewReservationManager(&cluster, policy, time.Duration(config.ReservationTTL)*time.Second, time.Duration(config.ReservationMaxTTL)*time.Second)
+	cluster.AddListener(reservations.Publish)
+
+	var history *HistoryStore
+	if config.HistoryPath != "" {
+		var err error
+		history, err = OpenHistory(config.HistoryPath)
+		if err != nil {
+			log.Fatalf("Failed to open history %s: %s", config.HistoryPath, err.Error())
+		}
+		cluster.AddListener(history.Record)
+		go history.Retain(time.Duration(config.HistoryRetention)*time.Second, time.Hour)
+		log.Printf("Initialized history from %s with retention of %ds", config.HistoryPath, config.HistoryRetention)
+	}
+	log.Printf("Initialized sync concurrency of %d (%d per node)", config.SyncConcurrency, config.SyncNodeConcurrency)
+
+	jobs := NewJobManager(&cluster)
+
+	// load the last saved model so that the API can serve it while the initial sync runs in the background
+	restored := false
+	if config.StatePath != "" {
+		snapshot, err := LoadState(config.StatePath)
+		if err != nil {
+			log.Printf("Failed to load state from %s: %s", config.StatePath, err.Error())
+		} else {
+			cluster.Restore(snapshot)
+			restored = true
+			if history != nil && history.Empty() { // history was started after the state was saved
+				history.Baseline(snapshot)
+			}
+			log.Printf("Loaded stale state of generation %d built at %s from %s", snapshot.Generation, snapshot.Built, config.StatePath)
+		}
+	}
+
+	if restored {
+		log.Printf("Starting background cluster sync\n")
+		jobs.SyncCluster(FullSync)
+	} else {
+		log.Printf("Starting cluster sync\n")
+		ctx, cancel := context.WithTimeout(context.Background(), JobTimeout)
+		stats, err := cluster.Sync(ctx, FullSync)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to sync cluster: %s", err.Error())
+		} else {
+			log.Printf("Synced cluster in %fs (%s)\n", stats.Duration.Seconds(), stats)
+		}
+	}
+
+	// set repeating save of the model
+	if config.StatePath != "" {
+		go cluster.PersistState(config.StatePath, time.Duration(config.StateInterval)*time.Second)
+		log.Printf("Initialized state save interval of %ds to %s", config.StateInterval, config.StatePath)
+	}
 
 	// set repeating update for full rebuilds
 	ticker := time.NewTicker(time.Duration(config.ReloadInterval) * time.Second)
-	log.Printf("Initialized cluster sync interval of %ds", config.ReloadInterval)
+	log.Printf("Initialized cluster sync interval of %ds in %s mode", config.ReloadInterval, config.SyncMode)
 	channel := make(chan bool)
 	go func() {
+		cycle := 0
 		for {
 			select {
 			case <-channel:
 				return
 			case <-ticker.C:
-				start := time.Now()
-				log.Printf("Starting cluster sync\n")
-				cluster.Sync()
-				log.Printf("Synced cluster in %fs\n", time.Since(start).Seconds())
+				cycle++
+				mode := config.SyncMode
+				if mode == FastSync && config.FullSyncEvery > 0 && cycle%config.FullSyncEvery == 0 {
+					mode = FullSync
+				}
+				jobs.SyncCluster(mode)
 			}
 		}
 	}()
 
+	// set task log watcher for targeted rebuilds after PVE tasks
+	if config.TaskPollInterval > 0 {
+		watcher := NewTaskWatcher(jobs, client, time.Duration(config.TaskPollInterval)*time.Second)
+		go watcher.Run(context.Background())
+		log.Printf("Initialized task watcher interval of %ds", config.TaskPollInterval)
+	}
+
 	router.GET("/version", func(c *gin.Context) {
-		PVEVersion, err := client.Version()
+		PVEVersion, err := client.Version(c.Request.Context())
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		} else {
@@ -66,30 +141,69 @@ func Run() {
 		}
 	})
 
+	router.GET("/nodes", ListHandler("nodes", (*Snapshot).ListNodes))
+	router.GET("/instances", ListHandler("instances", (*Snapshot).ListInstances))
+	router.GET("/volumes", ListHandler("volumes", (*Snapshot).ListVolumes))
+	router.GET("/devices", ListHandler("devices", (*Snapshot).ListDevices))
+
 	router.GET("/nodes/:node", func(c *gin.Context) {
 		nodeid := c.Param("node")
 
-		node, err := cluster.GetNode(nodeid)
+		snapshot, status, err := QuerySnapshot(c, history)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		node, err := snapshot.GetNode(nodeid)
 
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		} else {
-			c.JSON(http.StatusOK, gin.H{"node": node})
+			c.JSON(http.StatusOK, gin.H{"node": node, "generation": snapshot.Generation, "built": snapshot.Built, "stale": snapshot.Stale})
+			return
+		}
+	})
+
+	router.GET("/mappings", func(c *gin.Context) {
+		snapshot := cluster.Snapshot()
+		c.JSON(http.StatusOK, gin.H{"mappings": snapshot.ListMappings(), "generation": snapshot.Generation, "built": snapshot.Built, "stale": snapshot.Stale})
+	})
+
+	router.GET("/capacity", func(c *gin.Context) {
+		snapshot := cluster.Snapshot()
+		capacity := snapshot.ClusterCapacity(reservations.Pending(), config.Overcommit)
+		c.JSON(http.StatusOK, gin.H{"capacity": capacity, "generation": snapshot.Generation, "built": snapshot.Built, "stale": snapshot.Stale})
+	})
+
+	router.GET("/nodes/:node/capacity", func(c *gin.Context) {
+		nodeid := c.Param("node")
+
+		snapshot := cluster.Snapshot()
+		node, err := snapshot.GetNode(nodeid)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		capacity := snapshot.NodeCapacity(node, reservations.Pending(), config.Overcommit)
+		c.JSON(http.StatusOK, gin.H{"capacity": capacity, "generation": snapshot.Generation, "built": snapshot.Built, "stale": snapshot.Stale})
 	})
 
 	router.GET("/nodes/:node/devices", func(c *gin.Context) {
 		nodeid := c.Param("node")
 
-		node, err := cluster.GetNode(nodeid)
+		snapshot, status, err := QuerySnapshot(c, history)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		node, err := snapshot.GetNode(nodeid)
 
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		} else {
-			c.JSON(http.StatusOK, gin.H{"devices": node.Devices})
+			c.JSON(http.StatusOK, gin.H{"devices": node.Devices, "generation": snapshot.Generation, "built": snapshot.Built, "stale": snapshot.Stale})
 			return
 		}
 	})
@@ -102,7 +216,12 @@ func Run() {
 			return
 		}
 
-		node, err := cluster.GetNode(nodeid)
+		snapshot, status, err := QuerySnapshot(c, history)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		node, err := snapshot.GetNode(nodeid)
 
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -113,35 +232,273 @@ func Run() {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			} else {
-				c.JSON(http.StatusOK, gin.H{"instance": instance})
+				c.JSON(http.StatusOK, gin.H{"instance": instance, "generation": snapshot.Generation, "built": snapshot.Built, "stale": snapshot.Stale})
 				return
 			}
 		}
 	})
 
-	router.POST("/sync", func(c *gin.Context) {
-		//go func() {
-		start := time.Now()
-		log.Printf("Starting cluster sync\n")
-		cluster.Sync()
-		log.Printf("Synced cluster in %fs\n", time.Since(start).Seconds())
-		//}()
+	router.GET("/instances/:vmid", func(c *gin.Context) {
+		vmid, err := strconv.ParseUint(c.Param("vmid"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("%s could not be converted to vmid (uint)", c.Param("vmid"))})
+			return
+		}
+
+		snapshot, status, err := QuerySnapshot(c, history)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		nodeid, ok := snapshot.Locate(uint(vmid))
+		if !ok && c.Query("at") != "" {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("vmid %d not in cluster at %s", vmid, c.Query("at"))})
+			return
+		} else if !ok { // not in the model, check if PVE knows about it and sync it from the node it is on
+			nodeid, err = cluster.LocateInstance(c.Request.Context(), uint(vmid))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			_, err = cluster.RebuildInstance(c.Request.Context(), nodeid, uint(vmid))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "node": nodeid})
+				return
+			}
+			snapshot = cluster.Snapshot()
+			nodeid, ok = snapshot.Locate(uint(vmid))
+			if !ok {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("vmid %d not in cluster", vmid)})
+				return
+			}
+		}
+
+		node, err := snapshot.GetNode(nodeid)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		instance, err := node.GetInstance(uint(vmid))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		} else {
+			c.JSON(http.StatusOK, gin.H{"node": nodeid, "instance": instance, "generation": snapshot.Generation, "built": snapshot.Built, "stale": snapshot.Stale})
+			return
+		}
 	})
 
-	router.POST("/nodes/:node/sync", func(c *gin.Context) {
+	router.GET("/instances/:vmid/history", func(c *gin.Context) {
+		vmid, err := strconv.ParseUint(c.Param("vmid"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("%s could not be converted to vmid (uint)", c.Param("vmid"))})
+			return
+		}
+		if history == nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "history is disabled"})
+			return
+		}
+		since, until, err := QueryRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"vmid": vmid, "history": history.InstanceHistory(InstanceID(vmid), since, until)})
+	})
+
+	router.GET("/nodes/:node/devices/:bus/history", func(c *gin.Context) {
 		nodeid := c.Param("node")
-		//go func() {
-		start := time.Now()
-		log.Printf("Starting %s sync\n", nodeid)
-		err := cluster.RebuildHost(nodeid)
+		bus := DeviceBus(c.Param("bus"))
+		if history == nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "history is disabled"})
+			return
+		}
+		since, until, err := QueryRange(c)
 		if err != nil {
-			log.Printf("Failed to sync %s: %s", nodeid, err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
-		} else {
-			log.Printf("Synced %s in %fs\n", nodeid, time.Since(start).Seconds())
+		}
+
+		c.JSON(http.StatusOK, gin.H{"node": nodeid, "device": bus, "history": history.DeviceHistory(nodeid, bus, since, until)})
+	})
+
+	router.GET("/pools/:pool/usage", func(c *gin.Context) {
+		poolid := c.Param("pool")
+
+		snapshot := cluster.Snapshot()
+		usage, err := snapshot.PoolUsage(poolid)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		//}()
+		c.JSON(http.StatusOK, gin.H{"pool": poolid, "usage": usage, "generation": snapshot.Generation, "built": snapshot.Built, "stale": snapshot.Stale})
+	})
+
+	router.GET("/users/:user/usage", func(c *gin.Context) {
+		userid := c.Param("user")
+
+		snapshot := cluster.Snapshot()
+		usage, err := snapshot.UserUsage(userid)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"user": userid, "usage": usage, "generation": snapshot.Generation, "built": snapshot.Built, "stale": snapshot.Stale})
+	})
+
+	router.POST("/admission", func(c *gin.Context) {
+		request := AdmissionRequest{}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		snapshot := cluster.Snapshot()
+		result, err := snapshot.Admit(request, policy, reservations.Pending())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"allowed": result.Allowed, "checks": result.Checks, "generation": snapshot.Generation, "built": snapshot.Built, "stale": snapshot.Stale})
+	})
+
+	router.POST("/placement", func(c *gin.Context) {
+		request := PlacementRequest{}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if _, ok := PlacementStrategies[request.Strategy]; request.Strategy != "" && !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s is not a valid placement strategy (%s)", request.Strategy, StrategyNames())})
+			return
+		}
+
+		snapshot := cluster.Snapshot()
+		result, err := snapshot.Place(request, reservations.Pending(), config.Overcommit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"strategy": result.Strategy, "candidates": result.Candidates, "rejected": result.Rejected, "generation": snapshot.Generation, "built": snapshot.Built, "stale": snapshot.Stale})
+	})
+
+	router.POST("/reservations", func(c *gin.Context) {
+		request := ReservationRequest{}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		reservation, result, err := reservations.Reserve(request)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !result.Allowed {
+			c.JSON(http.StatusConflict, gin.H{"error": "requested resources are not available", "checks": result.Checks})
+			return
+		}
+		c.Header("Location", "/reservations/"+reservation.ID)
+		c.JSON(http.StatusCreated, gin.H{"reservation": reservation, "checks": result.Checks})
+	})
+
+	router.GET("/reservations/:id", func(c *gin.Context) {
+		reservation, err := reservations.Get(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"reservation": reservation})
+	})
+
+	router.POST("/reservations/:id/commit", func(c *gin.Context) {
+		reservation, err := reservations.Commit(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"reservation": reservation})
+	})
+
+	router.DELETE("/reservations/:id", func(c *gin.Context) {
+		reservation, err := reservations.Release(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"reservation": reservation})
+	})
+
+	router.GET("/vmids/next", func(c *gin.Context) {
+		user := c.Query("user")
+		vmids := config.VMIDs.Range(user)
+		if value := c.Query("min"); value != "" {
+			lowest, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s could not be converted to vmid (uint)", value)})
+				return
+			}
+			vmids.Min = max(vmids.Min, InstanceID(lowest))
+		}
+		if value := c.Query("max"); value != "" {
+			highest, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s could not be converted to vmid (uint)", value)})
+				return
+			}
+			vmids.Max = min(vmids.Max, InstanceID(highest))
+		}
+		if vmids.Min > vmids.Max {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("requested range is outside of the allowed range %d-%d", config.VMIDs.Range(user).Min, config.VMIDs.Range(user).Max)})
+			return
+		}
+		reserve, err := strconv.ParseBool(c.DefaultQuery("reserve", "false"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s is not a valid reserve (true, false)", c.Query("reserve"))})
+			return
+		}
+		ttl, err := strconv.Atoi(c.DefaultQuery("ttl", "0"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s could not be converted to ttl (int)", c.Query("ttl"))})
+			return
+		}
+
+		vmid, reservation, result, err := reservations.NextVMID(vmids, user, reserve, ttl)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if result != nil && !result.Allowed {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("vmid %d could not be reserved", vmid), "checks": result.Checks})
+			return
+		}
+		if reservation != nil {
+			c.Header("Location", "/reservations/"+reservation.ID)
+			c.JSON(http.StatusCreated, gin.H{"vmid": vmid, "reservation": reservation})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"vmid": vmid})
+	})
+
+	router.POST("/sync", func(c *gin.Context) {
+		mode := SyncMode(c.DefaultQuery("mode", string(config.SyncMode)))
+		if mode != FastSync && mode != FullSync {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s is not a valid sync mode (fast, full)", mode)})
+			return
+		}
+
+		job, coalesced := jobs.SyncCluster(mode)
+		c.Header("Location", "/jobs/"+job.ID)
+		c.JSON(http.StatusAccepted, gin.H{"job": job, "coalesced": coalesced})
+	})
+
+	router.POST("/nodes/:node/sync", func(c *gin.Context) {
+		nodeid := c.Param("node")
+
+		job, coalesced := jobs.SyncHost(nodeid)
+		c.Header("Location", "/jobs/"+job.ID)
+		c.JSON(http.StatusAccepted, gin.H{"job": job, "coalesced": coalesced})
 	})
 
 	router.POST("/nodes/:node/instances/:vmid/sync", func(c *gin.Context) {
@@ -152,32 +509,250 @@ func Run() {
 			return
 		}
 
-		//go func() {
-		start := time.Now()
-		log.Printf("Starting %s.%d sync\n", nodeid, vmid)
+		job, coalesced := jobs.SyncInstance(nodeid, uint(vmid))
+		c.Header("Location", "/jobs/"+job.ID)
+		c.JSON(http.StatusAccepted, gin.H{"job": job, "coalesced": coalesced})
+	})
 
-		node, err := cluster.GetNode(nodeid)
+	router.POST("/instances/:vmid/sync", func(c *gin.Context) {
+		vmid, err := strconv.ParseUint(c.Param("vmid"), 10, 64)
 		if err != nil {
-			log.Printf("Failed to sync %s.%d: %s", nodeid, vmid, err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("%s could not be converted to vmid (uint)", c.Param("vmid"))})
 			return
 		}
 
-		instance, err := node.GetInstance(uint(vmid))
+		nodeid, err := cluster.LocateInstance(c.Request.Context(), uint(vmid))
 		if err != nil {
-			log.Printf("Failed to sync %s.%d: %s", nodeid, vmid, err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		err = node.RebuildInstance(instance.Type, uint(vmid))
+		job, coalesced := jobs.SyncInstance(nodeid, uint(vmid))
+		c.Header("Location", "/jobs/"+job.ID)
+		c.JSON(http.StatusAccepted, gin.H{"job": job, "coalesced": coalesced})
+	})
+
+	router.GET("/events", EventsHandler(events))
+
+	router.GET("/jobs/:id", func(c *gin.Context) {
+		job, err := jobs.Get(c.Param("id"))
 		if err != nil {
-			log.Printf("Failed to sync %s.%d: %s", nodeid, vmid, err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		} else {
-			log.Printf("Synced %s.%d in %fs\n", nodeid, vmid, time.Since(start).Seconds())
+			c.JSON(http.StatusOK, gin.H{"job": job})
 			return
 		}
-		//}()
 	})
 
 	router.Run("0.0.0.0:" + strconv.Itoa(config.ListenPort))
 }
+
+// get the published snapshot, or the model as it was at the time given by the at query parameter, along with the status to respond with on error
+func QuerySnapshot(c *gin.Context, history *HistoryStore) (*Snapshot, int, error) {
+	value := c.Query("at")
+	if value == "" {
+		return cluster.Snapshot(), http.StatusOK, nil
+	}
+	at, err := ParseTime(value)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if history == nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("history is disabled")
+	}
+	snapshot, err := history.SnapshotAt(at)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return snapshot, http.StatusOK, nil
+}
+
+// get the time range given by the since and until query parameters, defaulting to all time
+func QueryRange(c *gin.Context) (time.Time, time.Time, error) {
+	since := time.Time{}
+	until := time.Now()
+	var err error
+	if value := c.Query("since"); value != "" {
+		if since, err = ParseTime(value); err != nil {
+			return since, until, err
+		}
+	}
+	if value := c.Query("until"); value != "" {
+		if until, err = ParseTime(value); err != nil {
+			return since, until, err
+		}
+	}
+	return since, until, nil
+}
+
+// creates a handler which lists a collection of the published snapshot with filtering, sorting and cursor pagination
+//
+// query parameters: node, type, name, storage, tag, pool, sort (numeric field), order (asc, desc), cursor, limit
+func ListHandler(collection string, list func(*Snapshot, ListFilter) []ListEntry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := ListQuery{
+			Filter: ListFilter{
+				Node:    c.Query("node"),
+				Type:    InstanceType(strings.ToUpper(c.Query("type"))),
+				Name:    c.Query("name"),
+				Storage: c.Query("storage"),
+				Tag:     c.Query("tag"),
+				Pool:    c.Query("pool"),
+			},
+			Sort:   c.Query("sort"),
+			Desc:   c.Query("order") == "desc",
+			Cursor: c.Query("cursor"),
+		}
+
+		if query.Filter.Type != "" && query.Filter.Type != VM && query.Filter.Type != CT {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s is not a valid type (VM, CT)", c.Query("type"))})
+			return
+		}
+		if order := c.Query("order"); order != "" && order != "asc" && order != "desc" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s is not a valid order (asc, desc)", order)})
+			return
+		}
+		if limit := c.Query("limit"); limit != "" {
+			l, err := strconv.Atoi(limit)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s could not be converted to limit (int)", limit)})
+				return
+			}
+			query.Limit = l
+		}
+
+		snapshot := cluster.Snapshot()
+		items, next, err := Paginate(list(snapshot, query.Filter), query)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{collection: items, "next": next, "generation": snapshot.Generation, "built": snapshot.Built, "stale": snapshot.Stale})
+	}
+}
+
+// how often a comment is sent to idle event feed clients to keep the connection open
+const EventKeepalive = 30 * time.Second
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true }, // the fabric api has no browser sessions to protect
+}
+
+// creates a handler which streams model change events as server sent events, or over a websocket if an upgrade is requested
+//
+// clients resume after reconnecting with the Last-Event-ID header or the last_event_id query parameter,
+// a resync event is sent first if some of the missed events are no longer available
+func EventsHandler(events *EventBus) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		lastEventID := c.GetHeader("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = c.Query("last_event_id")
+		}
+		after := uint64(0)
+		if lastEventID != "" {
+			id, err := strconv.ParseUint(lastEventID, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s could not be converted to event id (uint)", lastEventID)})
+				return
+			}
+			after = id
+		}
+
+		if websocket.IsWebSocketUpgrade(c.Request) {
+			conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+			if err != nil {
+				return // upgrader has already responded with an error
+			}
+			defer conn.Close()
+			streamEventsWebSocket(conn, events, after)
+			return
+		}
+
+		streamEventsSSE(c, events, after)
+	}
+}
+
+func streamEventsSSE(c *gin.Context, events *EventBus, after uint64) {
+	backlog, subscriber, complete := events.Subscribe(after)
+	defer events.Unsubscribe(subscriber)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	if !complete {
+		c.Render(-1, sse.Event{Event: "resync", Data: gin.H{"generation": cluster.Snapshot().Generation}})
+	}
+	for _, event := range backlog {
+		c.Render(-1, sse.Event{Id: strconv.FormatUint(event.ID, 10), Event: string(event.Type), Data: event})
+	}
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(EventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-keepalive.C:
+			c.Writer.WriteString(": keepalive\n\n")
+			c.Writer.Flush()
+		case event, ok := <-subscriber:
+			if !ok { // dropped for being too slow, the client will reconnect and resume
+				return
+			}
+			c.Render(-1, sse.Event{Id: strconv.FormatUint(event.ID, 10), Event: string(event.Type), Data: event})
+			c.Writer.Flush()
+		}
+	}
+}
+
+func streamEventsWebSocket(conn *websocket.Conn, events *EventBus, after uint64) {
+	backlog, subscriber, complete := events.Subscribe(after)
+	defer events.Unsubscribe(subscriber)
+
+	// read until the client closes the connection, clients are not expected to send anything
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if !complete {
+		if err := conn.WriteJSON(gin.H{"type": "resync", "generation": cluster.Snapshot().Generation}); err != nil {
+			return
+		}
+	}
+	for _, event := range backlog {
+		if err := conn.WriteJSON(event); err != nil {
+			return
+		}
+	}
+
+	keepalive := time.NewTicker(EventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-keepalive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case event, ok := <-subscriber:
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "subscriber fell behind"))
+				return
+			}
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		}
+	}
+}
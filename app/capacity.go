@@ -0,0 +1,260 @@
+package app
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// maximum ratios of allocated to physical resources, unset ratios default to 1 which allows no overcommit
+type OvercommitConfig struct {
+	Cores   float64 `json:"cores"`
+	Memory  float64 `json:"memory"`
+	Storage float64 `json:"storage"` // ratio of provisioned volume bytes to storage size
+}
+
+// allocation of a single resource, pending reservations count as allocated
+type ResourceCapacity struct {
+	Physical   uint64  `json:"physical"`
+	Allocated  uint64  `json:"allocated"`
+	Reserved   uint64  `json:"reserved"` // held by pending reservations
+	Ratio      float64 `json:"ratio"`    // allocated and reserved over physical
+	Limit      float64 `json:"limit"`    // configured overcommit limit
+	Budget     uint64  `json:"budget"`   // physical scaled by the overcommit limit
+	OverBudget bool    `json:"over_budget"`
+}
+
+type StorageCapacity struct {
+	Storage     string  `json:"storage"`
+	Shared      bool    `json:"shared"`
+	Active      bool    `json:"active"`
+	Size        uint64  `json:"size"`
+	Used        uint64  `json:"used"`
+	Provisioned uint64  `json:"provisioned"` // sum of volume sizes, across the whole cluster for shared storages
+	Reserved    uint64  `json:"reserved"`    // held by pending reservations
+	Ratio       float64 `json:"ratio"`       // provisioned and reserved over size
+	Limit       float64 `json:"limit"`
+	OverBudget  bool    `json:"over_budget"`
+}
+
+type DeviceCapacity struct {
+	Total      int            `json:"total"`
+	Reserved   int            `json:"reserved"` // assigned to instances in PVE
+	Pending    int            `json:"pending"`  // held by pending reservations
+	Free       int            `json:"free"`
+	FreeByName map[string]int `json:"free_by_name"`
+}
+
+type NodeCapacity struct {
+	Node       string                      `json:"node"`
+	Status     string                      `json:"status"`
+	Instances  int                         `json:"instances"` // including vmids held by pending reservations
+	Cores      ResourceCapacity            `json:"cores"`
+	Memory     ResourceCapacity            `json:"memory"`
+	Swap       ResourceCapacity            `json:"swap"`
+	Devices    DeviceCapacity              `json:"devices"`
+	Storages   map[string]*StorageCapacity `json:"storages"`
+	OverBudget bool                        `json:"over_budget"`
+	Reasons    []string                    `json:"reasons"` // why the node is over budget
+}
+
+// cluster wide totals, shared storages are counted once
+type ClusterCapacity struct {
+	Cores      ResourceCapacity            `json:"cores"`
+	Memory     ResourceCapacity            `json:"memory"`
+	Swap       ResourceCapacity            `json:"swap"`
+	Devices    DeviceCapacity              `json:"devices"`
+	Storages   map[string]*StorageCapacity `json:"storages"`
+	OverBudget []string                    `json:"over_budget"` // nodes which are over budget
+	Nodes      []*NodeCapacity             `json:"nodes"`
+}
+
+// get the ratio of a value over a total, 0 if the total is 0
+func Ratio(value uint64, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(value) / float64(total)
+}
+
+// get a configured overcommit limit, unset limits allow no overcommit
+func Limit(limit float64) float64 {
+	if limit <= 0 {
+		return 1
+	}
+	return limit
+}
+
+func NewResourceCapacity(physical uint64, allocated uint64, reserved uint64, limit float64) ResourceCapacity {
+	capacity := ResourceCapacity{
+		Physical:  physical,
+		Allocated: allocated,
+		Reserved:  reserved,
+		Ratio:     Ratio(allocated+reserved, physical),
+		Limit:     Limit(limit),
+	}
+	capacity.Budget = uint64(float64(physical) * capacity.Limit)
+	capacity.OverBudget = allocated+reserved > capacity.Budget
+	return capacity
+}
+
+// get the provisioned volume bytes of each storage, keyed by node then storage, with shared storages summed across the cluster
+func (snapshot *Snapshot) Provisioned() map[string]map[string]uint64 {
+	provisioned := map[string]map[string]uint64{}
+	shared := map[string]uint64{}
+	for hostName, host := range snapshot.Nodes {
+		provisioned[hostName] = map[string]uint64{}
+		for _, instance := range host.Instances {
+			for _, volume := range instance.Volumes {
+				if storage, ok := host.Storages[volume.Storage]; ok && storage.Shared {
+					shared[volume.Storage] += volume.Size
+				} else if volume.Storage != "" {
+					provisioned[hostName][volume.Storage] += volume.Size
+				}
+			}
+		}
+	}
+	for hostName, host := range snapshot.Nodes {
+		for storageName, storage := range host.Storages {
+			if storage.Shared {
+				provisioned[hostName][storageName] = shared[storageName]
+			}
+		}
+	}
+	return provisioned
+}
+
+// get the allocation of a node's resources against its physical resources and the overcommit limits
+func (snapshot *Snapshot) NodeCapacity(host *Node, pending []*Reservation, overcommit OvercommitConfig) *NodeCapacity {
+	return snapshot.nodeCapacity(host, pending, overcommit, snapshot.Provisioned())
+}
+
+func (snapshot *Snapshot) nodeCapacity(host *Node, pending []*Reservation, overcommit OvercommitConfig, provisioned map[string]map[string]uint64) *NodeCapacity {
+	allocated := snapshot.Usage(func(vmid InstanceID, instance *Instance) bool {
+		return snapshot.Index[vmid] == host.Name
+	})
+	reserved := Usage{Instances: []InstanceID{}, Disk: make(map[string]uint64), Devices: make(map[string]int)}
+	for _, reservation := range pending {
+		if reservation.Node == host.Name {
+			reserved.AddReservation(reservation)
+		}
+	}
+	held := PendingDevices(host.Name, pending)
+
+	capacity := NodeCapacity{
+		Node:      host.Name,
+		Status:    host.Status,
+		Instances: len(allocated.Instances) + len(reserved.Instances),
+		Cores:     NewResourceCapacity(host.Cores, allocated.Cores, reserved.Cores, overcommit.Cores),
+		Memory:    NewResourceCapacity(host.Memory, allocated.Memory, reserved.Memory, overcommit.Memory),
+		Swap:      NewResourceCapacity(host.Swap, allocated.Swap, reserved.Swap, 1),
+		Devices:   DeviceCapacity{FreeByName: make(map[string]int)},
+		Storages:  make(map[string]*StorageCapacity),
+		Reasons:   []string{},
+	}
+
+	for _, device := range host.Devices {
+		capacity.Devices.Total++
+		switch {
+		case device.Assigned():
+			capacity.Devices.Reserved++
+		case !host.DeviceFree(device, held):
+			capacity.Devices.Pending++
+		default:
+			capacity.Devices.Free++
+			capacity.Devices.FreeByName[device.Device_Name]++
+		}
+	}
+
+	for storageName, storage := range host.Storages {
+		storageCapacity := &StorageCapacity{
+			Storage:     storageName,
+			Shared:      storage.Shared,
+			Active:      storage.Active,
+			Size:        storage.Size,
+			Used:        storage.Used,
+			Provisioned: provisioned[host.Name][storageName],
+			Reserved:    reserved.Disk[storageName],
+			Limit:       Limit(overcommit.Storage),
+		}
+		if storage.Shared { // shared storages can be reserved through any node
+			storageCapacity.Reserved = 0
+			for _, reservation := range pending {
+				storageCapacity.Reserved += reservation.Disk[storageName]
+			}
+		}
+		storageCapacity.Ratio = Ratio(storageCapacity.Provisioned+storageCapacity.Reserved, storage.Size)
+		storageCapacity.OverBudget = float64(storageCapacity.Provisioned+storageCapacity.Reserved) > float64(storage.Size)*storageCapacity.Limit
+		capacity.Storages[storageName] = storageCapacity
+	}
+
+	if capacity.Cores.OverBudget {
+		capacity.Reasons = append(capacity.Reasons, fmt.Sprintf("cores overcommitted %.2fx over limit %.2fx", capacity.Cores.Ratio, capacity.Cores.Limit))
+	}
+	if capacity.Memory.OverBudget {
+		capacity.Reasons = append(capacity.Reasons, fmt.Sprintf("memory overcommitted %.2fx over limit %.2fx", capacity.Memory.Ratio, capacity.Memory.Limit))
+	}
+	for _, storageName := range slices.Sorted(maps.Keys(capacity.Storages)) {
+		if storage := capacity.Storages[storageName]; storage.OverBudget {
+			capacity.Reasons = append(capacity.Reasons, fmt.Sprintf("storage %s provisioned %.2fx over limit %.2fx", storageName, storage.Ratio, storage.Limit))
+		}
+	}
+	capacity.OverBudget = len(capacity.Reasons) > 0
+
+	return &capacity
+}
+
+// get the capacity of every node and the cluster wide totals
+func (snapshot *Snapshot) ClusterCapacity(pending []*Reservation, overcommit OvercommitConfig) *ClusterCapacity {
+	provisioned := snapshot.Provisioned()
+	cluster := ClusterCapacity{
+		Devices:    DeviceCapacity{FreeByName: make(map[string]int)},
+		Storages:   make(map[string]*StorageCapacity),
+		OverBudget: []string{},
+		Nodes:      []*NodeCapacity{},
+	}
+
+	var cores, memory, swap ResourceCapacity
+	for _, hostName := range slices.Sorted(maps.Keys(snapshot.Nodes)) {
+		capacity := snapshot.nodeCapacity(snapshot.Nodes[hostName], pending, overcommit, provisioned)
+		cluster.Nodes = append(cluster.Nodes, capacity)
+		if capacity.OverBudget {
+			cluster.OverBudget = append(cluster.OverBudget, hostName)
+		}
+
+		for _, total := range []struct {
+			sum  *ResourceCapacity
+			node ResourceCapacity
+		}{{&cores, capacity.Cores}, {&memory, capacity.Memory}, {&swap, capacity.Swap}} {
+			total.sum.Physical += total.node.Physical
+			total.sum.Allocated += total.node.Allocated
+			total.sum.Reserved += total.node.Reserved
+		}
+
+		cluster.Devices.Total += capacity.Devices.Total
+		cluster.Devices.Reserved += capacity.Devices.Reserved
+		cluster.Devices.Pending += capacity.Devices.Pending
+		cluster.Devices.Free += capacity.Devices.Free
+		for name, free := range capacity.Devices.FreeByName {
+			cluster.Devices.FreeByName[name] += free
+		}
+
+		for storageName, storage := range capacity.Storages {
+			key := storageName
+			if !storage.Shared { // local storages with the same name are different storages
+				key = hostName + "/" + storageName
+			}
+			if _, ok := cluster.Storages[key]; ok { // shared storage already counted through another node
+				continue
+			}
+			total := *storage
+			cluster.Storages[key] = &total
+		}
+	}
+
+	cluster.Cores = NewResourceCapacity(cores.Physical, cores.Allocated, cores.Reserved, overcommit.Cores)
+	cluster.Memory = NewResourceCapacity(memory.Physical, memory.Allocated, memory.Reserved, overcommit.Memory)
+	cluster.Swap = NewResourceCapacity(swap.Physical, swap.Allocated, swap.Reserved, 1)
+
+	return &cluster
+}
@@ -0,0 +1,125 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+// number of recent events kept so that clients can resume after reconnecting
+const EventHistorySize = 4096
+
+// number of events buffered for each subscriber before it is dropped for being too slow
+const EventSubscriberBuffer = 256
+
+// a change to the model as delivered to event feed clients
+type Event struct {
+	ID         uint64    `json:"id"`
+	Generation uint64    `json:"generation"`
+	Time       time.Time `json:"time"`
+	Change
+}
+
+// fans out model changes to subscribers and keeps a short history for resuming
+//
+// event ids continue from the unix time in microseconds the bus was created at, so that ids stay unique across restarts
+type EventBus struct {
+	lock        sync.Mutex
+	first       uint64 // id events of this process start after
+	last        uint64
+	history     []Event
+	subscribers map[chan Event]bool
+	handlers    []func(Event)
+}
+
+func NewEventBus() *EventBus {
+	epoch := uint64(time.Now().UnixMicro())
+	return &EventBus{
+		first:       epoch,
+		last:        epoch,
+		history:     []Event{},
+		subscribers: make(map[chan Event]bool),
+	}
+}
+
+// registers a function to be called with every event, unlike subscribers handlers are never dropped
+//
+// handlers are called with the bus lock held and must not block, handlers must be added before the first event is published
+func (bus *EventBus) AddHandler(handler func(Event)) {
+	bus.handlers = append(bus.handlers, handler)
+}
+
+// converts each change of a published snapshot to an event and delivers it to every subscriber
+//
+// subscribers which have fallen too far behind are dropped, they can resume from their last event id after reconnecting
+func (bus *EventBus) Publish(snapshot *Snapshot, changes []Change) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	for _, change := range changes {
+		bus.last++
+		event := Event{
+			ID:         bus.last,
+			Generation: snapshot.Generation,
+			Time:       snapshot.Built,
+			Change:     change,
+		}
+
+		bus.history = append(bus.history, event)
+		if len(bus.history) > EventHistorySize {
+			bus.history = bus.history[len(bus.history)-EventHistorySize:]
+		}
+
+		for _, handler := range bus.handlers {
+			handler(event)
+		}
+
+		for subscriber := range bus.subscribers {
+			select {
+			case subscriber <- event:
+			default: // subscriber is too slow
+				delete(bus.subscribers, subscriber)
+				close(subscriber)
+			}
+		}
+	}
+}
+
+// subscribes to events published after the event with id after, 0 subscribes to new events only
+//
+// returns the events after the given id which are still in the history, the channel of new events,
+// and false if events after the given id are no longer available and the client should refetch the model
+func (bus *EventBus) Subscribe(after uint64) ([]Event, chan Event, bool) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	complete := true
+	backlog := []Event{}
+	if after > bus.last || (after > 0 && after < bus.first) { // id is from another run of the process
+		complete = false
+	} else if after > 0 {
+		if len(bus.history) > 0 && bus.history[0].ID > after+1 {
+			complete = false
+		}
+		for _, event := range bus.history {
+			if event.ID > after {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+
+	subscriber := make(chan Event, EventSubscriberBuffer)
+	bus.subscribers[subscriber] = true
+
+	return backlog, subscriber, complete
+}
+
+// stops delivering events to a subscriber
+func (bus *EventBus) Unsubscribe(subscriber chan Event) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	if bus.subscribers[subscriber] {
+		delete(bus.subscribers, subscriber)
+		close(subscriber)
+	}
+}
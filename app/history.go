@@ -0,0 +1,388 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// a single change recorded in the history store along with the state of the changed node, instance or device after the change
+type HistoryRecord struct {
+	Seq        uint64    `json:"seq"`
+	Time       time.Time `json:"time"`
+	Generation uint64    `json:"generation"`
+	Change
+	NodeState     *Node      `json:"node_state,omitempty"`     // node without its instances, set for node changes other than removal
+	InstanceState *Instance  `json:"instance_state,omitempty"` // set for instance changes other than removal
+	DeviceState   *Device    `json:"device_state,omitempty"`
+	USBState      *USBDevice `json:"usb_state,omitempty"`
+}
+
+// append-only store of every change published to the model, used to rebuild the model as it was at any point in time
+//
+// records are appended to a file as json lines and indexed in memory by node, instance and device,
+// records older than the retention period are compacted away by Retain
+type HistoryStore struct {
+	lock      sync.RWMutex
+	path      string
+	file      *os.File
+	last      uint64
+	first     time.Time
+	nodes     map[string][]*HistoryRecord
+	instances map[InstanceID][]*HistoryRecord
+	devices   map[string][]*HistoryRecord // keyed by node name and device bus, see DeviceKey
+}
+
+// opens the history file at path, creating it if it does not exist, and indexes its records
+//
+// a partially written record at the end of the file is discarded
+func OpenHistory(path string) (*HistoryStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	store := HistoryStore{
+		path:      path,
+		file:      file,
+		nodes:     make(map[string][]*HistoryRecord),
+		instances: make(map[InstanceID][]*HistoryRecord),
+		devices:   make(map[string][]*HistoryRecord),
+	}
+
+	decoder := json.NewDecoder(file)
+	var offset int64
+	for {
+		record := HistoryRecord{}
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Discarding history after offset %d of %s: %s", offset, path, err.Error())
+			break
+		}
+		offset = decoder.InputOffset()
+		store.index(&record)
+	}
+
+	// drop anything after the last complete record and continue appending from there
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &store, nil
+}
+
+// type of the marker record written at the start of a compacted history, its time is the compaction cutoff
+const HistoryCutoff ChangeType = "history_cutoff"
+
+func DeviceKey(hostName string, bus DeviceBus) string {
+	return hostName + "/" + string(bus)
+}
+
+// adds a record to the in memory indexes, must be called with the store lock held
+func (store *HistoryStore) index(record *HistoryRecord) {
+	if record.Type == HistoryCutoff { // history before the cutoff was compacted away
+		store.first = record.Time
+		return
+	}
+	if store.first.IsZero() {
+		store.first = record.Time
+	}
+	store.last = record.Seq
+
+	switch record.Type {
+	case NodeAdded, NodeRemoved, NodeUpdated, NodeUp, NodeDown:
+		store.nodes[record.Node] = append(store.nodes[record.Node], record)
+	case InstanceAdded, InstanceRemoved, InstanceUpdated, InstanceMoved:
+		store.instances[record.VMID] = append(store.instances[record.VMID], record)
+	case DeviceReserved, DeviceReleased, USBReserved, USBReleased:
+		key := DeviceKey(record.Node, record.Device)
+		store.devices[key] = append(store.devices[key], record)
+		if record.VMID != 0 { // also part of the holding instance's timeline
+			store.instances[record.VMID] = append(store.instances[record.VMID], record)
+		}
+	}
+}
+
+// returns true if the store has no records
+func (store *HistoryStore) Empty() bool {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.last == 0
+}
+
+// records the changes of a published snapshot, used as a cluster listener
+func (store *HistoryStore) Record(snapshot *Snapshot, changes []Change) {
+	store.append(snapshot, changes)
+}
+
+// records every node and instance of a snapshot as added, used to start the history of a model which was loaded from the state file
+func (store *HistoryStore) Baseline(snapshot *Snapshot) {
+	changes := []Change{}
+	for _, hostName := range slices.Sorted(maps.Keys(snapshot.Nodes)) {
+		host := snapshot.Nodes[hostName]
+		changes = append(changes, Change{Type: NodeAdded, Node: hostName})
+		for _, vmid := range slices.Sorted(maps.Keys(host.Instances)) {
+			changes = append(changes, Change{Type: InstanceAdded, Node: hostName, VMID: vmid})
+		}
+	}
+	store.append(snapshot, changes)
+}
+
+func (store *HistoryStore) append(snapshot *Snapshot, changes []Change) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	content := []byte{}
+	for _, change := range changes {
+		record := HistoryRecord{
+			Seq:        store.last + 1,
+			Time:       snapshot.Built,
+			Generation: snapshot.Generation,
+			Change:     change,
+		}
+		host := snapshot.Nodes[change.Node]
+		if host != nil {
+			switch change.Type {
+			case NodeAdded, NodeUpdated, NodeUp, NodeDown:
+				state := *host
+				state.Instances = nil
+				record.NodeState = &state
+			case InstanceAdded, InstanceUpdated, InstanceMoved:
+				record.InstanceState = host.Instances[change.VMID]
+			case DeviceReserved, DeviceReleased:
+				record.DeviceState = host.Devices[change.Device]
+			case USBReserved, USBReleased:
+				record.USBState = host.USBDevices[string(change.Device)]
+			}
+		}
+
+		line, err := json.Marshal(record)
+		if err != nil {
+			log.Printf("Failed to encode history record for %s: %s", change.Type, err.Error())
+			continue
+		}
+		content = append(append(content, line...), '\n')
+		store.index(&record)
+	}
+
+	if len(content) == 0 {
+		return
+	}
+	if _, err := store.file.Write(content); err != nil {
+		log.Printf("Failed to write history: %s", err.Error())
+	}
+}
+
+// compacts the history every interval, dropping records older than retention
+func (store *HistoryStore) Retain(retention time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		if err := store.Compact(time.Now().Add(-retention)); err != nil {
+			log.Printf("Failed to compact history %s: %s", store.path, err.Error())
+		}
+		<-ticker.C
+	}
+}
+
+// rewrites the history without the records at or before cutoff, except the last state of each node and instance which still exists at cutoff
+//
+// the model can still be rebuilt at any time after cutoff, but not before it
+func (store *HistoryStore) Compact(cutoff time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.last == 0 || !cutoff.After(store.first) {
+		return nil
+	}
+
+	keep := map[uint64]bool{}
+	for _, records := range store.nodes {
+		record := latest(records, cutoff, func(record *HistoryRecord) bool { return record.NodeState != nil || record.Type == NodeRemoved })
+		if record != nil && record.Type != NodeRemoved {
+			keep[record.Seq] = true
+		}
+	}
+	for _, records := range store.instances {
+		record := latest(records, cutoff, func(record *HistoryRecord) bool { return record.InstanceState != nil || record.Type == InstanceRemoved })
+		if record != nil && record.Type != InstanceRemoved {
+			keep[record.Seq] = true
+		}
+	}
+
+	// instances also index the device records of devices they held, so records are deduplicated by seq
+	kept := map[uint64]*HistoryRecord{}
+	for _, index := range []map[string][]*HistoryRecord{store.nodes, store.devices} {
+		for _, records := range index {
+			for _, record := range records {
+				if record.Time.After(cutoff) || keep[record.Seq] {
+					kept[record.Seq] = record
+				}
+			}
+		}
+	}
+	for _, records := range store.instances {
+		for _, record := range records {
+			if record.Time.After(cutoff) || keep[record.Seq] {
+				kept[record.Seq] = record
+			}
+		}
+	}
+
+	// write the kept records to a temporary file and replace the history with it
+	temp, err := os.CreateTemp(filepath.Dir(store.path), filepath.Base(store.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name()) // no-op once renamed
+	encoder := json.NewEncoder(temp)
+	if err := encoder.Encode(HistoryRecord{Time: cutoff, Change: Change{Type: HistoryCutoff}}); err != nil {
+		temp.Close()
+		return err
+	}
+	for _, seq := range slices.Sorted(maps.Keys(kept)) {
+		if err := encoder.Encode(kept[seq]); err != nil {
+			temp.Close()
+			return err
+		}
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := os.Rename(temp.Name(), store.path); err != nil {
+		temp.Close()
+		return err
+	}
+	store.file.Close()
+	store.file = temp // the renamed file is positioned at its end for further appends
+
+	last := store.last
+	store.last = 0
+	store.first = time.Time{}
+	store.nodes = make(map[string][]*HistoryRecord)
+	store.instances = make(map[InstanceID][]*HistoryRecord)
+	store.devices = make(map[string][]*HistoryRecord)
+	for _, seq := range slices.Sorted(maps.Keys(kept)) {
+		store.index(kept[seq])
+	}
+	store.last = last // seqs are never reused even if the newest records were compacted
+	store.first = cutoff
+	return nil
+}
+
+// get the last record at or before a time which passes filter
+func latest(records []*HistoryRecord, at time.Time, filter func(*HistoryRecord) bool) *HistoryRecord {
+	for i := len(records) - 1; i >= 0; i-- {
+		if !records[i].Time.After(at) && filter(records[i]) {
+			return records[i]
+		}
+	}
+	return nil
+}
+
+// rebuilds the model as it was at a point in time, only exported state is available in the rebuilt model
+func (store *HistoryStore) SnapshotAt(at time.Time) (*Snapshot, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	if store.last == 0 || at.Before(store.first) {
+		return nil, fmt.Errorf("no history before %s", at.Format(time.RFC3339))
+	}
+
+	snapshot := Snapshot{
+		Built:    store.first,
+		Nodes:    make(map[string]*Node),
+		Access:   NewAccess(), // access and mappings are not recorded
+		Mappings: NewMappings(),
+	}
+	seen := func(record *HistoryRecord) {
+		if record.Generation >= snapshot.Generation {
+			snapshot.Generation = record.Generation
+			snapshot.Built = record.Time
+		}
+	}
+
+	added := map[string]uint64{} // seq of the record which last added each node
+	for hostName, records := range store.nodes {
+		record := latest(records, at, func(record *HistoryRecord) bool { return record.NodeState != nil || record.Type == NodeRemoved })
+		if record == nil || record.Type == NodeRemoved {
+			continue
+		}
+		seen(record)
+		host := *record.NodeState
+		host.Instances = make(map[InstanceID]*Instance)
+		snapshot.Nodes[hostName] = &host
+		if record := latest(records, at, func(record *HistoryRecord) bool { return record.Type == NodeAdded }); record != nil {
+			added[hostName] = record.Seq
+		}
+	}
+
+	for vmid, records := range store.instances {
+		record := latest(records, at, func(record *HistoryRecord) bool { return record.InstanceState != nil || record.Type == InstanceRemoved })
+		if record == nil || record.Type == InstanceRemoved {
+			continue
+		}
+		host, ok := snapshot.Nodes[record.Node]
+		if !ok || record.Seq < added[record.Node] { // node was removed, or removed and added again, since the instance was recorded
+			continue
+		}
+		seen(record)
+		host.Instances[vmid] = record.InstanceState
+	}
+
+	snapshot.Index = BuildIndex(snapshot.Nodes)
+	return &snapshot, nil
+}
+
+// get the records of an instance, including reservations and releases of devices it held, between two times
+func (store *HistoryStore) InstanceHistory(vmid InstanceID, since time.Time, until time.Time) []*HistoryRecord {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return between(store.instances[vmid], since, until)
+}
+
+// get the reservations and releases of a device between two times
+func (store *HistoryStore) DeviceHistory(hostName string, bus DeviceBus, since time.Time, until time.Time) []*HistoryRecord {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return between(store.devices[DeviceKey(hostName, bus)], since, until)
+}
+
+func between(records []*HistoryRecord, since time.Time, until time.Time) []*HistoryRecord {
+	result := []*HistoryRecord{}
+	for _, record := range records {
+		if !record.Time.Before(since) && !record.Time.After(until) {
+			result = append(result, record)
+		}
+	}
+	return result
+}
+
+// parses a time given as RFC 3339 or unix seconds
+func ParseTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.New("time must be RFC 3339 or unix seconds")
+	}
+	return t, nil
+}
@@ -0,0 +1,170 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// how long finished jobs can be polled before they are discarded
+const JobRetention = 10 * time.Minute
+
+// how long a single run of a job may take before its requests to PVE are cancelled
+const JobTimeout = 10 * time.Minute
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+)
+
+// a sync running in the background, requests for the same target are coalesced into the job while it is in flight
+//
+// a request coalesced into a running job makes the job run once more after it finishes, because the running sync may have read PVE before the change the request is for
+type Job struct {
+	ID       string     `json:"id"`
+	Target   string     `json:"target"`
+	State    JobState   `json:"state"`
+	Created  time.Time  `json:"created"`
+	Started  time.Time  `json:"started,omitzero"`
+	Finished time.Time  `json:"finished,omitzero"`
+	Error    string     `json:"error,omitempty"`
+	Stats    *SyncStats `json:"stats,omitempty"`
+	Runs     int        `json:"runs"` // a running job is run again if a request for its target arrives while it runs
+	run      func(ctx context.Context) (*SyncStats, error)
+	rerun    bool
+}
+
+type JobManager struct {
+	lock     sync.Mutex
+	cluster  *Cluster
+	jobs     map[string]*Job
+	inflight map[string]*Job // queued or running job of each target
+}
+
+func NewJobManager(cluster *Cluster) *JobManager {
+	return &JobManager{
+		cluster:  cluster,
+		jobs:     make(map[string]*Job),
+		inflight: make(map[string]*Job),
+	}
+}
+
+// starts a sync of the whole cluster
+func (manager *JobManager) SyncCluster(mode SyncMode) (Job, bool) {
+	return manager.Submit(fmt.Sprintf("cluster:%s", mode), func(ctx context.Context) (*SyncStats, error) {
+		return manager.cluster.Sync(ctx, mode)
+	})
+}
+
+// starts a sync of a single node
+func (manager *JobManager) SyncHost(hostName string) (Job, bool) {
+	return manager.Submit(fmt.Sprintf("node:%s", hostName), func(ctx context.Context) (*SyncStats, error) {
+		return manager.cluster.RebuildHost(ctx, hostName)
+	})
+}
+
+// starts a sync of a single instance expected on hostName, instances are targeted by vmid alone because they may move between nodes
+func (manager *JobManager) SyncInstance(hostName string, vmid uint) (Job, bool) {
+	return manager.Submit(fmt.Sprintf("instance:%d", vmid), func(ctx context.Context) (*SyncStats, error) {
+		return manager.cluster.RebuildInstance(ctx, hostName, vmid)
+	})
+}
+
+// starts run in the background unless a job for the same target is already in flight
+//
+// returns a copy of the started or in flight job, and true if the request was coalesced into an in flight job
+func (manager *JobManager) Submit(target string, run func(ctx context.Context) (*SyncStats, error)) (Job, bool) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	manager.prune()
+
+	if job, ok := manager.inflight[target]; ok {
+		if job.State == JobRunning {
+			job.rerun = true
+		}
+		return *job, true
+	}
+
+	job := &Job{
+		ID:      rand.Text(),
+		Target:  target,
+		State:   JobQueued,
+		Created: time.Now(),
+		run:     run,
+	}
+	manager.jobs[job.ID] = job
+	manager.inflight[target] = job
+
+	go manager.execute(job)
+
+	return *job, false
+}
+
+// get a copy of a job by its id
+func (manager *JobManager) Get(id string) (Job, error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	job, ok := manager.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("job %s not found", id)
+	}
+	return *job, nil
+}
+
+func (manager *JobManager) execute(job *Job) {
+	manager.lock.Lock()
+	job.State = JobRunning
+	job.Started = time.Now()
+	manager.lock.Unlock()
+
+	var stats *SyncStats
+	var err error
+	for {
+		manager.lock.Lock()
+		job.rerun = false
+		job.Runs++
+		manager.lock.Unlock()
+
+		log.Printf("Starting %s sync (job %s)\n", job.Target, job.ID)
+		ctx, cancel := context.WithTimeout(context.Background(), JobTimeout)
+		stats, err = job.run(ctx)
+		cancel()
+
+		manager.lock.Lock()
+		if !job.rerun {
+			break // keeps the lock held to finish the job
+		}
+		manager.lock.Unlock()
+	}
+	defer manager.lock.Unlock()
+
+	job.Finished = time.Now()
+	job.Stats = stats
+	if err != nil {
+		job.State = JobFailed
+		job.Error = err.Error()
+		log.Printf("Failed to sync %s (job %s): %s", job.Target, job.ID, err.Error())
+	} else {
+		job.State = JobSucceeded
+		log.Printf("Synced %s in %fs (%s) (job %s)\n", job.Target, stats.Duration.Seconds(), stats, job.ID)
+	}
+	delete(manager.inflight, job.Target)
+}
+
+// discards finished jobs older than the retention period, must be called with the manager lock held
+func (manager *JobManager) prune() {
+	for id, job := range manager.jobs {
+		if !job.Finished.IsZero() && time.Since(job.Finished) > JobRetention {
+			delete(manager.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package app
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const DefaultListLimit = 100
+const MaxListLimit = 1000
+
+// filters shared by every listing, empty filters match everything
+//
+// type, tag and pool match instances, and volumes or devices belonging to matching instances
+type ListFilter struct {
+	Node    string
+	Type    InstanceType
+	Name    string
+	Storage string
+	Tag     string
+	Pool    string
+}
+
+type ListQuery struct {
+	Filter ListFilter
+	Sort   string // numeric field to sort by, entries are otherwise ordered by their key
+	Desc   bool
+	Cursor string // opaque cursor returned with the previous page
+	Limit  int
+}
+
+// a single item of a listing along with the unique key used to order it and resume after it
+type ListEntry struct {
+	key  string
+	Item any
+}
+
+type InstanceEntry struct {
+	Node string     `json:"node"`
+	VMID InstanceID `json:"vmid"`
+	*Instance
+}
+
+type VolumeEntry struct {
+	Node         string       `json:"node"`
+	VMID         InstanceID   `json:"vmid"`
+	InstanceType InstanceType `json:"instance_type"`
+	*Volume
+}
+
+type DeviceEntry struct {
+	Node      string       `json:"node"`
+	Instances []InstanceID `json:"instances"` // instances the device is assigned to
+	*Device
+}
+
+type listCursor struct {
+	Value float64 `json:"v"`
+	Key   string  `json:"k"`
+}
+
+// checks if an instance on a node matches every instance level filter
+func (filter ListFilter) MatchesInstance(hostName string, instance *Instance) bool {
+	if filter.Node != "" && filter.Node != hostName {
+		return false
+	}
+	if filter.Type != "" && !strings.EqualFold(string(filter.Type), string(instance.Type)) {
+		return false
+	}
+	if filter.Name != "" && !strings.Contains(strings.ToLower(instance.Name), strings.ToLower(filter.Name)) {
+		return false
+	}
+	if filter.Tag != "" && !slices.Contains(instance.Tags, filter.Tag) {
+		return false
+	}
+	if filter.Pool != "" && filter.Pool != instance.Pool {
+		return false
+	}
+	if filter.Storage != "" {
+		found := false
+		for _, volume := range instance.Volumes {
+			found = found || volume.Storage == filter.Storage
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// checks if the filter has any instance level filters which nodes and devices must match through their instances
+func (filter ListFilter) hasInstanceFilters() bool {
+	return filter.Type != "" || filter.Tag != "" || filter.Pool != ""
+}
+
+// list nodes matching the filter, nodes match type, tag and pool if they host a matching instance
+func (snapshot *Snapshot) ListNodes(filter ListFilter) []ListEntry {
+	entries := []ListEntry{}
+	for hostName, host := range snapshot.Nodes {
+		if filter.Node != "" && filter.Node != hostName {
+			continue
+		}
+		if filter.Name != "" && !strings.Contains(strings.ToLower(hostName), strings.ToLower(filter.Name)) {
+			continue
+		}
+		if _, ok := host.Storages[filter.Storage]; filter.Storage != "" && !ok {
+			continue
+		}
+		if filter.hasInstanceFilters() {
+			instanceFilter := ListFilter{Type: filter.Type, Tag: filter.Tag, Pool: filter.Pool}
+			found := false
+			for _, instance := range host.Instances {
+				found = found || instanceFilter.MatchesInstance(hostName, instance)
+			}
+			if !found {
+				continue
+			}
+		}
+		entries = append(entries, ListEntry{key: hostName, Item: host})
+	}
+	return entries
+}
+
+// list instances matching the filter
+func (snapshot *Snapshot) ListInstances(filter ListFilter) []ListEntry {
+	entries := []ListEntry{}
+	for hostName, host := range snapshot.Nodes {
+		for vmid, instance := range host.Instances {
+			if !filter.MatchesInstance(hostName, instance) {
+				continue
+			}
+			entries = append(entries, ListEntry{
+				key:  fmt.Sprintf("%010d", vmid),
+				Item: InstanceEntry{Node: hostName, VMID: vmid, Instance: instance},
+			})
+		}
+	}
+	return entries
+}
+
+// list volumes matching the filter, name matches the name of the volume's instance
+func (snapshot *Snapshot) ListVolumes(filter ListFilter) []ListEntry {
+	entries := []ListEntry{}
+	instanceFilter := filter
+	instanceFilter.Storage = "" // storage is matched per volume
+	for hostName, host := range snapshot.Nodes {
+		for vmid, instance := range host.Instances {
+			if !instanceFilter.MatchesInstance(hostName, instance) {
+				continue
+			}
+			for volid, volume := range instance.Volumes {
+				if filter.Storage != "" && filter.Storage != volume.Storage {
+					continue
+				}
+				entries = append(entries, ListEntry{
+					key:  fmt.Sprintf("%010d/%s", vmid, volid),
+					Item: VolumeEntry{Node: hostName, VMID: vmid, InstanceType: instance.Type, Volume: volume},
+				})
+			}
+		}
+	}
+	return entries
+}
+
+// list node devices matching the filter, name matches the device or vendor name
+//
+// devices match type, tag, pool and storage if they are assigned to a matching instance
+func (snapshot *Snapshot) ListDevices(filter ListFilter) []ListEntry {
+	entries := []ListEntry{}
+	instanceFilter := ListFilter{Type: filter.Type, Tag: filter.Tag, Pool: filter.Pool, Storage: filter.Storage}
+	for hostName, host := range snapshot.Nodes {
+		if filter.Node != "" && filter.Node != hostName {
+			continue
+		}
+
+		// find the instances each device is assigned to
+		holders := map[DeviceBus][]InstanceID{}
+		matched := map[DeviceBus]bool{}
+		for _, assignment := range host.DeviceAssignments() {
+			if !slices.Contains(holders[assignment.Bus], assignment.VMID) {
+				holders[assignment.Bus] = append(holders[assignment.Bus], assignment.VMID)
+			}
+			matched[assignment.Bus] = matched[assignment.Bus] || instanceFilter.MatchesInstance(hostName, host.Instances[assignment.VMID])
+		}
+
+		for bus, device := range host.Devices {
+			if filter.Name != "" && !strings.Contains(strings.ToLower(device.Device_Name), strings.ToLower(filter.Name)) && !strings.Contains(strings.ToLower(device.Vendor_Name), strings.ToLower(filter.Name)) {
+				continue
+			}
+			if (filter.hasInstanceFilters() || filter.Storage != "") && !matched[bus] {
+				continue
+			}
+			instances := holders[bus]
+			if instances == nil {
+				instances = []InstanceID{}
+			}
+			entries = append(entries, ListEntry{
+				key:  fmt.Sprintf("%s/%s", hostName, bus),
+				Item: DeviceEntry{Node: hostName, Instances: instances, Device: device},
+			})
+		}
+	}
+	return entries
+}
+
+// sorts entries and returns the page after the query's cursor along with the cursor for the next page, or "" if this is the last page
+func Paginate(entries []ListEntry, query ListQuery) ([]any, string, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	limit = min(limit, MaxListLimit)
+
+	// get the sort value of each entry, entries without the field sort as 0
+	values := make(map[string]float64, len(entries))
+	if query.Sort != "" {
+		numeric := false
+		for _, entry := range entries {
+			value, ok := NumericField(entry.Item, query.Sort)
+			values[entry.key] = value
+			numeric = numeric || ok
+		}
+		if !numeric && len(entries) > 0 {
+			return nil, "", fmt.Errorf("%s is not a numeric field", query.Sort)
+		}
+	}
+
+	compare := func(value float64, key string, otherValue float64, otherKey string) int {
+		c := cmp.Compare(value, otherValue)
+		if query.Desc {
+			c = -c
+		}
+		if c == 0 {
+			c = cmp.Compare(key, otherKey)
+		}
+		return c
+	}
+
+	slices.SortFunc(entries, func(a ListEntry, b ListEntry) int {
+		return compare(values[a.key], a.key, values[b.key], b.key)
+	})
+
+	start := 0
+	if query.Cursor != "" {
+		cursor, err := decodeListCursor(query.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		start, _ = slices.BinarySearchFunc(entries, cursor, func(entry ListEntry, cursor listCursor) int {
+			if compare(values[entry.key], entry.key, cursor.Value, cursor.Key) <= 0 {
+				return -1
+			}
+			return 1
+		})
+	}
+
+	end := min(start+limit, len(entries))
+	items := make([]any, 0, end-start)
+	for _, entry := range entries[start:end] {
+		items = append(items, entry.Item)
+	}
+
+	next := ""
+	if end < len(entries) {
+		last := entries[end-1]
+		next = encodeListCursor(listCursor{Value: values[last.key], Key: last.key})
+	}
+
+	return items, next, nil
+}
+
+// get a top level numeric field of an item by its json name
+func NumericField(item any, field string) (float64, bool) {
+	content, err := json.Marshal(item)
+	if err != nil {
+		return 0, false
+	}
+	fields := map[string]any{}
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return 0, false
+	}
+	value, ok := fields[field].(float64)
+	return value, ok
+}
+
+func encodeListCursor(cursor listCursor) string {
+	content, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func decodeListCursor(encoded string) (listCursor, error) {
+	cursor := listCursor{}
+	content, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, fmt.Errorf("%s is not a valid cursor", encoded)
+	}
+	if err := json.Unmarshal(content, &cursor); err != nil {
+		return cursor, fmt.Errorf("%s is not a valid cursor", encoded)
+	}
+	return cursor, nil
+}
@@ -0,0 +1,138 @@
+package app
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// a resource mapping with its availability and reservation on each node
+type MappingEntry struct {
+	ID          string             `json:"id"`
+	Type        string             `json:"type"` // pci or usb
+	Description string             `json:"description"`
+	Nodes       []MappingNodeEntry `json:"nodes"`
+}
+
+type MappingNodeEntry struct {
+	Node      string       `json:"node"`
+	Paths     []string     `json:"paths"`
+	Available bool         `json:"available"` // node is online and has a mapped device which is not reserved
+	Reserved  bool         `json:"reserved"`  // every mapped device on the node is reserved
+	Instances []InstanceID `json:"instances"` // instances on the node assigned a device through the mapping
+}
+
+// get the pci bus ids a mapping resolves to on the node
+//
+// a mapping with several devices on a node can be assigned any one of them when its instance starts,
+// which one is not part of the instance config so the node attributes mapped devices in DeviceAssignments
+func (host *Node) ResolveMapping(mappingName string) ([]DeviceID, error) {
+	if host.mappings == nil {
+		return nil, fmt.Errorf("mapping %s not found, mappings of host %s are unknown", mappingName, host.Name)
+	}
+	mapping, ok := host.mappings.PCI[mappingName]
+	if !ok {
+		return nil, fmt.Errorf("mapping %s not found", mappingName)
+	}
+	paths := mapping.Nodes[host.Name]
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("mapping %s has no devices on host %s", mappingName, host.Name)
+	}
+	busIDs := []DeviceID{}
+	for _, path := range paths {
+		busIDs = append(busIDs, NormalizeDeviceBusID(DeviceID(path)))
+	}
+	return busIDs, nil
+}
+
+// lists every pci and usb mapping with its availability and reservation on each node
+func (snapshot *Snapshot) ListMappings() []MappingEntry {
+	entries := []MappingEntry{}
+	for _, mappingType := range []string{"pci", "usb"} {
+		mappings := snapshot.Mappings.PCI
+		if mappingType == "usb" {
+			mappings = snapshot.Mappings.USB
+		}
+		for _, id := range slices.Sorted(maps.Keys(mappings)) {
+			mapping := mappings[id]
+			entry := MappingEntry{ID: id, Type: mappingType, Description: mapping.Description, Nodes: []MappingNodeEntry{}}
+			for _, hostName := range slices.Sorted(maps.Keys(mapping.Nodes)) {
+				entry.Nodes = append(entry.Nodes, snapshot.MappingNode(mappingType, mapping, hostName))
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// get the availability and reservation of a mapping on a node
+func (snapshot *Snapshot) MappingNode(mappingType string, mapping *Mapping, hostName string) MappingNodeEntry {
+	entry := MappingNodeEntry{Node: hostName, Paths: mapping.Nodes[hostName], Instances: []InstanceID{}}
+	host, ok := snapshot.Nodes[hostName]
+	if !ok {
+		return entry
+	}
+
+	for _, vmid := range slices.Sorted(maps.Keys(host.Instances)) {
+		instance := host.Instances[vmid]
+		mapped := false
+		if mappingType == "usb" {
+			for _, usbdevice := range instance.USBDevices {
+				mapped = mapped || usbdevice.Mapping == mapping.ID
+			}
+		} else {
+			for _, device := range instance.Devices {
+				mapped = mapped || device.Mapping == mapping.ID
+			}
+		}
+		if mapped {
+			entry.Instances = append(entry.Instances, vmid)
+		}
+	}
+
+	reserved := 0
+	found := 0
+	if mappingType == "usb" {
+		counted := map[string]bool{}
+		for _, path := range entry.Paths {
+			for _, usbdevice := range host.FindUSBDevices(path) {
+				if counted[usbdevice.USB_Path] {
+					continue
+				}
+				counted[usbdevice.USB_Path] = true
+				found++
+				if usbdevice.Reserved {
+					reserved++
+				}
+			}
+		}
+		entry.Reserved = found > 0 && reserved == found
+		entry.Available = host.Status == NodeOnline && found > reserved
+		return entry
+	}
+
+	for _, path := range entry.Paths {
+		busID := NormalizeDeviceBusID(DeviceID(path))
+		x := strings.Split(string(busID), ".")
+		device, ok := host.Devices[DeviceBus(x[0])]
+		if !ok {
+			continue
+		}
+		isReserved := device.Reserved
+		if len(x) == 2 { // sub function mapping
+			function, ok := device.Functions[FunctionID(x[1])]
+			if !ok {
+				continue
+			}
+			isReserved = function.Reserved
+		}
+		found++
+		if isReserved {
+			reserved++
+		}
+	}
+	entry.Reserved = found > 0 && reserved == found
+	entry.Available = host.Status == NodeOnline && found > reserved
+	return entry
+}
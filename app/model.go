@@ -1,194 +1,1222 @@
 package app
 
 import (
+	"cmp"
+	"context"
 	"fmt"
 	"log"
+	"maps"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/luthermonson/go-proxmox"
 )
 
-func (cluster *Cluster) Init(pve ProxmoxClient) {
+func (cluster *Cluster) Init(pve ProxmoxClient, scheduler *Scheduler) {
 	cluster.pve = pve
+	cluster.scheduler = scheduler
+	cluster.changed = make(map[InstanceID]uint64)
+	cluster.snapshot.Store(&Snapshot{
+		Generation: 0,
+		Built:      time.Now(),
+		Nodes:      make(map[string]*Node),
+		Index:      make(map[InstanceID]string),
+		Access:     NewAccess(),
+		Mappings:   NewMappings(),
+	})
+}
+
+func NewMappings() *Mappings {
+	return &Mappings{
+		PCI: make(map[string]*Mapping),
+		USB: make(map[string]*Mapping),
+	}
+}
+
+func NewAccess() *Access {
+	return &Access{
+		Pools: make(map[string]*Pool),
+		Users: make(map[string]*User),
+	}
 }
 
-func (cluster *Cluster) Sync() error {
-	// aquire lock on cluster, release on return
+// replaces the published snapshot with one loaded from the state file, must be called before the first sync
+func (cluster *Cluster) Restore(snapshot *Snapshot) {
+	cluster.snapshot.Store(snapshot)
+}
+
+// registers a function to be called with each newly published snapshot and the changes it contains
+//
+// listeners are called with the cluster lock held and must not block, listeners must be added before the first sync
+func (cluster *Cluster) AddListener(listener func(*Snapshot, []Change)) {
+	cluster.listeners = append(cluster.listeners, listener)
+}
+
+// get the most recently published snapshot, snapshots are immutable and can be read without locking
+func (cluster *Cluster) Snapshot() *Snapshot {
+	return cluster.snapshot.Load()
+}
+
+// get a node in the most recently published snapshot
+func (cluster *Cluster) GetNode(hostName string) (*Node, error) {
+	return cluster.Snapshot().GetNode(hostName)
+}
+
+// get a node in the snapshot
+func (snapshot *Snapshot) GetNode(hostName string) (*Node, error) {
+	host, ok := snapshot.Nodes[hostName]
+	if !ok {
+		return nil, fmt.Errorf("%s not in cluster", hostName)
+	}
+	return host, nil
+}
+
+// get the name of the node which owns a vmid in the snapshot
+func (snapshot *Snapshot) Locate(vmid uint) (string, bool) {
+	hostName, ok := snapshot.Index[InstanceID(vmid)]
+	return hostName, ok
+}
+
+// get the name of the node which owns a vmid, using the published snapshot and falling back to /cluster/resources for guests not yet in the model
+func (cluster *Cluster) LocateInstance(ctx context.Context, vmid uint) (string, error) {
+	if hostName, ok := cluster.Snapshot().Locate(vmid); ok {
+		return hostName, nil
+	}
+
+	inventory, err := cluster.FetchInventory(ctx)
+	if err != nil {
+		return "", err
+	}
+	resource, ok := inventory.Guests[InstanceID(vmid)]
+	if !ok {
+		return "", fmt.Errorf("vmid %d not in cluster", vmid)
+	}
+	return resource.Node, nil
+}
+
+// fetches the inventory of the cluster, keeping the published mappings if the mappings could not be fetched
+func (cluster *Cluster) FetchInventory(ctx context.Context) (*Inventory, error) {
+	inventory, err := cluster.pve.Inventory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if inventory.Mappings == nil {
+		inventory.Mappings = cluster.Snapshot().Mappings
+	}
+	return inventory, nil
+}
+
+// maps each vmid to the name of the node which owns it
+func BuildIndex(nodes map[string]*Node) map[InstanceID]string {
+	index := make(map[InstanceID]string)
+	for hostName, host := range nodes {
+		for vmid := range host.Instances {
+			index[vmid] = hostName
+		}
+	}
+	return index
+}
+
+// publishes a new snapshot with the given nodes, access and mappings if there were any changes, any node was replaced, or a sync refreshed a stale snapshot,
+// must be called with the cluster lock held
+//
+// synced is true only for a sync of the whole cluster, which is the only publish that clears the stale flag of a snapshot loaded from the state file
+func (cluster *Cluster) publish(nodes map[string]*Node, access *Access, mappings *Mappings, changes []Change, synced bool) *Snapshot {
+	current := cluster.Snapshot()
+	if len(changes) == 0 && !(current.Stale && synced) && maps.Equal(current.Nodes, nodes) {
+		return current
+	}
+
+	next := &Snapshot{
+		Generation: current.Generation + 1,
+		Built:      time.Now(),
+		Nodes:      nodes,
+		Index:      BuildIndex(nodes),
+		Access:     access,
+		Mappings:   mappings,
+		Stale:      current.Stale && !synced,
+	}
+	cluster.snapshot.Store(next)
+
+	for _, change := range changes {
+		if change.VMID != 0 {
+			cluster.changed[change.VMID] = next.Generation
+		}
+	}
+
+	for _, listener := range cluster.listeners {
+		listener(next, changes)
+	}
+
+	return next
+}
+
+// fetches the current state of every node and publishes a snapshot containing only the differences
+//
+// in fast mode, guests whose /cluster/resources state is unchanged keep their published instance instead of being refetched
+//
+// nodes and instances are rebuilt in parallel within the limits of the cluster's scheduler, and the sync stops early if ctx is cancelled
+func (cluster *Cluster) Sync(ctx context.Context, mode SyncMode) (*SyncStats, error) {
+	stats := NewSyncStats()
+	stats.Mode = mode
+
+	// get the node, guest and storage inventory in a single request
+	inventory, err := cluster.FetchInventory(ctx)
+	if err != nil {
+		return stats, err
+	}
+	nodes := slices.Sorted(maps.Keys(inventory.Nodes))
+
+	// pools and ownership are only refreshed by cluster syncs, if they cannot be fetched the current access is kept
+	fetchedAccess, err := cluster.pve.Access(ctx)
+	if err != nil {
+		log.Printf("Failed to retrieve pools and ACL: %s", err.Error())
+		fetchedAccess = nil
+	}
+
+	// build each node in parallel without holding the cluster lock, readers continue to use the current snapshot
+	current := cluster.Snapshot()
+	base := current.Generation
+	fresh := make(map[string]*Node)
+	var freshLock sync.Mutex
+	var wg sync.WaitGroup
+	for _, hostName := range nodes {
+		if inventory.Nodes[hostName].Status != "online" {
+			log.Printf("Skipping %s sync, node is %s\n", hostName, inventory.Nodes[hostName].Status)
+			continue
+		}
+		previous := current.Nodes[hostName]
+		wg.Go(func() {
+			host, err := cluster.BuildHost(ctx, hostName, inventory, previous, mode, stats)
+			if err != nil { // if an error was encountered, continue and log the error
+				log.Print(err.Error())
+				return
+			}
+			freshLock.Lock()
+			fresh[hostName] = host
+			freshLock.Unlock()
+		})
+	}
+	wg.Wait()
+
+	// a cancelled sync has an incomplete view of the cluster and must not be published
+	if err := ctx.Err(); err != nil {
+		return stats, err
+	}
+
+	// aquire lock on cluster to serialize writers, release on return
 	cluster.lock.Lock()
 	defer cluster.lock.Unlock()
 
-	cluster.Nodes = make(map[string]*Node)
+	current = cluster.Snapshot()
+	next := make(map[string]*Node)
 
-	// get all nodes
-	nodes, err := cluster.pve.Nodes()
-	if err != nil {
-		return err
+	for hostName := range current.Nodes {
+		if _, ok := inventory.Nodes[hostName]; !ok { // node was removed from the cluster
+			stats.Changes = append(stats.Changes, Change{Type: NodeRemoved, Node: hostName})
+		}
 	}
-	// for each node:
+	rebuilt := map[string]bool{}
 	for _, hostName := range nodes {
-		// rebuild node
-		err := cluster.RebuildHost(hostName)
-		if err != nil { // if an error was encountered, continue and log the error
+		if host, ok := fresh[hostName]; ok {
+			cluster.KeepNewer(host, current, base)
+			merged, changes := MergeHost(current.Nodes[hostName], host)
+			next[hostName] = merged
+			rebuilt[hostName] = true
+			stats.Changes = append(stats.Changes, changes...)
+		} else if host, ok := current.Nodes[hostName]; ok { // node is offline or unreachable, keep its last known state
+			down, changes := MarkHostDown(host)
+			next[hostName] = down
+			stats.Changes = append(stats.Changes, changes...)
+		}
+	}
+	stats.Changes = Reconcile(current, next, rebuilt, stats.Changes)
+
+	access := current.Access
+	if fetchedAccess != nil && !reflect.DeepEqual(current.Access, fetchedAccess) {
+		access = fetchedAccess
+		stats.Changes = append(stats.Changes, Change{Type: AccessUpdated})
+	}
+
+	mappings := current.Mappings
+	if !reflect.DeepEqual(current.Mappings, inventory.Mappings) {
+		mappings = inventory.Mappings
+		stats.Changes = append(stats.Changes, Change{Type: MappingsUpdated})
+	}
+
+	stats.Generation = cluster.publish(next, access, mappings, stats.Changes, true).Generation
+	stats.Duration = time.Since(stats.Started)
+	return stats, nil
+}
+
+// fetches the current state of a single node and publishes a snapshot containing only the differences
+func (cluster *Cluster) RebuildHost(ctx context.Context, hostName string) (*SyncStats, error) {
+	stats := NewSyncStats()
+	stats.Mode = FullSync
+
+	inventory, err := cluster.FetchInventory(ctx)
+	if err != nil {
+		return stats, err
+	}
+
+	previous := cluster.Snapshot()
+	host, err := cluster.BuildHost(ctx, hostName, inventory, previous.Nodes[hostName], FullSync, stats)
+	if err != nil {
+		return stats, err
+	}
+
+	// aquire lock on cluster to serialize writers, release on return
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	current := cluster.Snapshot()
+	cluster.KeepNewer(host, current, previous.Generation)
+	nodes := maps.Clone(current.Nodes)
+	nodes[hostName], stats.Changes = MergeHost(current.Nodes[hostName], host)
+	rebuilt := map[string]bool{hostName: true}
+
+	// follow guests which left this node to the node they now live on so that migrations are seen as a single move
+	for _, change := range slices.Clone(stats.Changes) {
+		if change.Type != InstanceRemoved {
+			continue
+		}
+		resource, ok := inventory.Guests[change.VMID]
+		if !ok || resource.Node == hostName {
+			continue
+		}
+		changes, err := cluster.rebuildInstanceIn(ctx, nodes, inventory, resource, stats)
+		if err != nil {
 			log.Print(err.Error())
 			continue
 		}
+		rebuilt[resource.Node] = true
+		stats.Changes = append(stats.Changes, changes...)
 	}
+	stats.Changes = Reconcile(current, nodes, rebuilt, stats.Changes)
 
-	return nil
+	stats.Generation = cluster.publish(nodes, current.Access, current.Mappings, stats.Changes, false).Generation
+	stats.Duration = time.Since(stats.Started)
+	return stats, nil
 }
 
-// get a node in the cluster
-func (cluster *Cluster) GetNode(hostName string) (*Node, error) {
-	host_ch := make(chan *Node)
-	err_ch := make(chan error)
-
-	go func() {
-		// aquire cluster lock
-		cluster.lock.Lock()
-		defer cluster.lock.Unlock()
-		// get host
-		host, ok := cluster.Nodes[hostName]
-		if !ok {
-			host_ch <- nil
-			err_ch <- fmt.Errorf("%s not in cluster", hostName)
-		} else {
-			// aquire host lock to wait in case of a concurrent write
-			host.lock.Lock()
-			defer host.lock.Unlock()
+// fetches the current state of a single instance and publishes a snapshot containing it if it changed
+//
+// hostName is the node the instance is expected to be on, if the instance has moved it is rebuilt on the node it now lives on
+// and removed from hostName, if the instance no longer exists it is removed from the model
+func (cluster *Cluster) RebuildInstance(ctx context.Context, hostName string, vmid uint) (*SyncStats, error) {
+	stats := NewSyncStats()
+	stats.Mode = FullSync
 
-			host_ch <- host
-			err_ch <- nil
+	inventory, err := cluster.FetchInventory(ctx)
+	if err != nil {
+		return stats, err
+	}
+
+	// aquire lock on cluster to serialize writers, release on return
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	current := cluster.Snapshot()
+	nodes := maps.Clone(current.Nodes)
+	rebuilt := map[string]bool{}
+
+	resource, ok := inventory.Guests[InstanceID(vmid)]
+	if !ok { // instance was destroyed, remove it from every node which still has it
+		owner, owned := current.Index[InstanceID(vmid)]
+		if !owned {
+			return stats, fmt.Errorf("vmid %d not in cluster", vmid)
+		}
+		stats.Changes = RemoveInstance(nodes, owner, InstanceID(vmid))
+	} else {
+		stats.Changes, err = cluster.rebuildInstanceIn(ctx, nodes, inventory, resource, stats)
+		if err != nil {
+			return stats, err
+		}
+		rebuilt[resource.Node] = true
+		if resource.Node != hostName {
+			log.Printf("Instance %d expected on %s was found on %s\n", vmid, hostName, resource.Node)
 		}
-	}()
+	}
+	stats.Changes = Reconcile(current, nodes, rebuilt, stats.Changes)
+
+	stats.Generation = cluster.publish(nodes, current.Access, current.Mappings, stats.Changes, false).Generation
+	stats.Duration = time.Since(stats.Started)
+	return stats, nil
+}
+
+// rebuilds a single instance on the node given by its /cluster/resources entry, replacing that node in nodes with an updated copy
+//
+// must be called with the cluster lock held, nodes must not be a published map
+func (cluster *Cluster) rebuildInstanceIn(ctx context.Context, nodes map[string]*Node, inventory *Inventory, resource *proxmox.ClusterResource, stats *SyncStats) ([]Change, error) {
+	hostName := resource.Node
+	vmid := InstanceID(resource.VMID)
+	changes := []Change{}
 
-	host := <-host_ch
-	err := <-err_ch
+	host, ok := nodes[hostName]
+	if !ok {
+		return changes, fmt.Errorf("%s not in cluster", hostName)
+	}
+
+	// build the instance against a copy of the host so that the published host is never modified
+	instance, exists := host.Instances[vmid]
+	next := host.Clone()
+	next.mappings = inventory.Mappings
+	var fresh *Instance
+	rebuilt := false
+	err := cluster.scheduler.Do(ctx, hostName, func() error {
+		var err error
+		if next.pvenode == nil { // host was loaded from the state file and has not been synced yet
+			next.pvenode, err = cluster.pve.PVENode(ctx, hostName)
+			if err != nil {
+				return err
+			}
+		}
+		fresh, rebuilt, err = next.BuildInstance(ctx, resource, instance)
+		return err
+	})
+	if err != nil {
+		return changes, err
+	}
+	stats.Count(rebuilt)
 
-	return host, err
+	if exists && instance.Equal(fresh) {
+		if instance.resourceState != fresh.resourceState { // replaced without a change, see MergeHost
+			next.Instances[vmid] = fresh
+			nodes[hostName] = next
+		}
+		return changes, nil
+	}
+
+	next.Instances[vmid] = fresh
+	next.RebuildReservations()
+	if !exists { // instance was created or moved here since the host was last synced
+		changes = append(changes, Change{Type: InstanceAdded, Node: hostName, VMID: vmid})
+	} else {
+		changes = append(changes, Change{Type: InstanceUpdated, Node: hostName, VMID: vmid})
+	}
+	if !host.EqualResources(next) {
+		changes = append(changes, Change{Type: NodeUpdated, Node: hostName})
+		changes = append(changes, DiffDevices(host, next)...)
+	}
+	nodes[hostName] = next
+
+	return changes, nil
 }
 
-func (cluster *Cluster) RebuildHost(hostName string) error {
-	host, err := cluster.pve.Node(hostName)
-	if err != nil { // host is probably down or otherwise unreachable
-		return fmt.Errorf("error retrieving %s: %s, possibly down?", hostName, err.Error())
+// removes an instance from a node, replacing that node in nodes with an updated copy
+//
+// nodes must not be a published map
+func RemoveInstance(nodes map[string]*Node, hostName string, vmid InstanceID) []Change {
+	changes := []Change{}
+
+	host, ok := nodes[hostName]
+	if !ok {
+		return changes
+	}
+	if _, ok := host.Instances[vmid]; !ok {
+		return changes
 	}
 
-	// aquire lock on host, release on return
-	host.lock.Lock()
-	defer host.lock.Unlock()
+	next := host.Clone()
+	delete(next.Instances, vmid)
+	next.RebuildReservations()
+	changes = append(changes, Change{Type: InstanceRemoved, Node: hostName, VMID: vmid})
+	if !host.EqualResources(next) {
+		changes = append(changes, Change{Type: NodeUpdated, Node: hostName})
+		changes = append(changes, DiffDevices(host, next)...)
+	}
+	nodes[hostName] = next
 
-	cluster.Nodes[hostName] = host
+	return changes
+}
 
-	// get node's VMs
-	vms, err := host.VirtualMachines()
-	if err != nil {
-		return err
+// replaces the instances of a node built from PVE with the published instances of every vmid changed after generation base, must be called with the cluster lock held
+//
+// nodes are built without the cluster lock, so a targeted rebuild published while the node was being built has newer data than the node
+func (cluster *Cluster) KeepNewer(fresh *Node, current *Snapshot, base uint64) {
+	kept := false
+	for vmid, generation := range cluster.changed {
+		if generation <= base {
+			continue
+		}
+		kept = true
+		if owner, ok := current.Index[vmid]; ok && owner == fresh.Name {
+			fresh.Instances[vmid] = current.Nodes[owner].Instances[vmid]
+		} else { // instance was moved away or removed
+			delete(fresh.Instances, vmid)
+		}
+	}
+	if kept {
+		fresh.RebuildReservations()
+	}
+}
 
+// ensures that every vmid lives on exactly one node and reports guests which changed nodes as moves
+//
+// if a vmid is found on more than one node, the copy on a rebuilt node is kept and the stale copies are removed,
+// then each instance added to a node which was previously on another node is reported as a single move instead of an add and a remove
+//
+// nodes must not be a published map
+func Reconcile(previous *Snapshot, nodes map[string]*Node, rebuilt map[string]bool, changes []Change) []Change {
+	owners := map[InstanceID][]string{}
+	for _, hostName := range slices.Sorted(maps.Keys(nodes)) {
+		for vmid := range nodes[hostName].Instances {
+			owners[vmid] = append(owners[vmid], hostName)
+		}
 	}
-	for _, vmid := range vms {
-		err := host.RebuildInstance(VM, vmid)
-		if err != nil { // if an error was encountered, continue and log the error
-			log.Print(err.Error())
+
+	for _, vmid := range slices.Sorted(maps.Keys(owners)) {
+		hosts := owners[vmid]
+		if len(hosts) < 2 {
 			continue
 		}
+		keep := hosts[0]
+		for _, hostName := range hosts {
+			if rebuilt[hostName] {
+				keep = hostName
+				break
+			}
+		}
+		for _, hostName := range hosts {
+			if hostName != keep {
+				changes = append(changes, RemoveInstance(nodes, hostName, vmid)...)
+			}
+		}
 	}
 
-	// get node's CTs
-	cts, err := host.Containers()
-	if err != nil {
+	// find the node each added instance was previously on
+	movedFrom := map[InstanceID]string{}
+	for _, change := range changes {
+		if change.Type != InstanceAdded {
+			continue
+		}
+		if from, ok := previous.Index[change.VMID]; ok && from != change.Node {
+			movedFrom[change.VMID] = from
+		}
+	}
+
+	reconciled := []Change{}
+	for _, change := range changes {
+		from, moved := movedFrom[change.VMID]
+		switch {
+		case moved && change.Type == InstanceRemoved && change.Node == from:
+			continue // reported as part of the move
+		case moved && change.Type == InstanceAdded:
+			change.Type = InstanceMoved
+			change.From = from
+		}
+		reconciled = append(reconciled, change)
+	}
+
+	return reconciled
+}
+
+// builds a complete node with all of its instances from PVE without touching the published snapshot
+//
+// in fast mode, instances of the previous node are reused for guests whose /cluster/resources state is unchanged,
+// otherwise the previous instance is only used to skip parsing configs whose digest is unchanged
+//
+// instances are fetched in parallel within the limits of the cluster's scheduler, and an error is returned if ctx is cancelled
+func (cluster *Cluster) BuildHost(ctx context.Context, hostName string, inventory *Inventory, previous *Node, mode SyncMode, stats *SyncStats) (*Node, error) {
+	var host *Node
+	err := cluster.scheduler.Do(ctx, hostName, func() error {
+		var err error
+		host, err = cluster.pve.Node(ctx, hostName)
 		return err
+	})
+	if err != nil { // host is probably down or otherwise unreachable
+		return nil, fmt.Errorf("error retrieving %s: %s, possibly down?", hostName, err.Error())
+	}
+
+	host.Status = NodeOnline
+	host.mappings = inventory.Mappings
+	for storageName, resource := range inventory.Storages[hostName] {
+		host.Storages[storageName] = GetStorageInfo(resource)
+	}
+
+	// get node's VMs and CTs
+	var instancesLock sync.Mutex
+	var wg sync.WaitGroup
+	for _, vmid := range slices.Sorted(maps.Keys(inventory.Guests)) {
+		resource := inventory.Guests[vmid]
+		if resource.Node != hostName {
+			continue
+		}
+
+		var previousInstance *Instance
+		if previous != nil {
+			previousInstance = previous.Instances[vmid]
+		}
+
+		// instances with mapped devices are refetched when the mappings changed so that their devices are linked again
+		mappingsChanged := previous != nil && !reflect.DeepEqual(previous.mappings, inventory.Mappings)
+		if mode == FastSync && previousInstance != nil && previousInstance.resourceState == ResourceState(resource) && !(mappingsChanged && previousInstance.HasMappedDevices()) {
+			instancesLock.Lock()
+			host.Instances[vmid] = previousInstance
+			instancesLock.Unlock()
+			stats.CountReused()
+			continue
+		}
+
+		wg.Go(func() {
+			var instance *Instance
+			rebuilt := false
+			err := cluster.scheduler.Do(ctx, hostName, func() error {
+				var err error
+				instance, rebuilt, err = host.BuildInstance(ctx, resource, previousInstance)
+				return err
+			})
+			if err != nil { // if an error was encountered, continue and log the error
+				log.Print(err.Error())
+				return
+			}
+			stats.Count(rebuilt)
+			instancesLock.Lock()
+			host.Instances[vmid] = instance
+			instancesLock.Unlock()
+		})
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	host.RebuildReservations()
+
+	return host, nil
+}
+
+// merges a freshly built node with the published node and returns the node to publish along with the changes between them
+//
+// unchanged instances keep their published pointers so that consecutive snapshots share as much of the model as possible
+func MergeHost(host *Node, fresh *Node) (*Node, []Change) {
+	if host == nil { // node is new to the cluster, every instance is also new
+		changes := []Change{{Type: NodeAdded, Node: fresh.Name}}
+		for _, vmid := range slices.Sorted(maps.Keys(fresh.Instances)) {
+			changes = append(changes, Change{Type: InstanceAdded, Node: fresh.Name, VMID: vmid})
+		}
+		return fresh, changes
+	}
+
+	// instances whose /cluster/resources state changed without changing the model are replaced without a change,
+	// so that fast syncs compare against the new state instead of refetching them every cycle,
+	// likewise a node whose live usage changed is published without a change
+	changes := DiffHost(host, fresh)
+	refreshed := false
+	for vmid, instance := range host.Instances {
+		if freshInstance, ok := fresh.Instances[vmid]; ok && instance.Equal(freshInstance) && instance.resourceState != freshInstance.resourceState {
+			refreshed = true
+		}
+	}
+	if len(changes) == 0 && !refreshed && host.Equal(fresh) {
+		return host, changes
+	}
+
+	for vmid, instance := range host.Instances {
+		if freshInstance, ok := fresh.Instances[vmid]; ok && instance.Equal(freshInstance) && instance.resourceState == freshInstance.resourceState {
+			fresh.Instances[vmid] = instance
+		}
+	}
+
+	return fresh, changes
+}
+
+// get a copy of an unreachable node marked as offline, along with the change if the node was previously online
+func MarkHostDown(host *Node) (*Node, []Change) {
+	if host.Status == NodeOffline {
+		return host, []Change{}
+	}
+	down := *host
+	down.Status = NodeOffline
+	return &down, []Change{{Type: NodeDown, Node: host.Name}}
+}
+
+// compares a published node against a freshly built one and returns the changes between them
+func DiffHost(host *Node, fresh *Node) []Change {
+	changes := []Change{}
+
+	if host.Status != fresh.Status {
+		if fresh.Status == NodeOnline {
+			changes = append(changes, Change{Type: NodeUp, Node: host.Name})
+		} else {
+			changes = append(changes, Change{Type: NodeDown, Node: host.Name})
+		}
+	}
+
+	if !host.EqualResources(fresh) {
+		changes = append(changes, Change{Type: NodeUpdated, Node: host.Name})
+		changes = append(changes, DiffDevices(host, fresh)...)
+	}
+
+	for _, vmid := range slices.Sorted(maps.Keys(host.Instances)) {
+		if _, ok := fresh.Instances[vmid]; !ok {
+			changes = append(changes, Change{Type: InstanceRemoved, Node: host.Name, VMID: vmid})
+		}
+	}
+
+	for _, vmid := range slices.Sorted(maps.Keys(fresh.Instances)) {
+		instance, ok := host.Instances[vmid]
+		if !ok {
+			changes = append(changes, Change{Type: InstanceAdded, Node: host.Name, VMID: vmid})
+		} else if !instance.Equal(fresh.Instances[vmid]) {
+			changes = append(changes, Change{Type: InstanceUpdated, Node: host.Name, VMID: vmid})
+		}
+	}
+
+	return changes
+}
+
+// compares the reservation of each device of a published node against a newer node and returns the devices which were reserved or released
+func DiffDevices(host *Node, fresh *Node) []Change {
+	changes := []Change{}
+
+	for _, bus := range slices.Sorted(maps.Keys(fresh.Devices)) {
+		wasReserved := host.Devices[bus] != nil && host.Devices[bus].Reserved
+		isReserved := fresh.Devices[bus].Reserved
+		if !wasReserved && isReserved {
+			changes = append(changes, Change{Type: DeviceReserved, Node: fresh.Name, VMID: fresh.DeviceHolder(bus), Device: bus})
+		}
 	}
-	for _, vmid := range cts {
-		err := host.RebuildInstance(CT, vmid)
+	for _, bus := range slices.Sorted(maps.Keys(host.Devices)) {
+		wasReserved := host.Devices[bus].Reserved
+		isReserved := fresh.Devices[bus] != nil && fresh.Devices[bus].Reserved
+		if wasReserved && !isReserved {
+			changes = append(changes, Change{Type: DeviceReleased, Node: host.Name, VMID: host.DeviceHolder(bus), Device: bus})
+		}
+	}
+
+	for _, usbpath := range slices.Sorted(maps.Keys(fresh.USBDevices)) {
+		wasReserved := host.USBDevices[usbpath] != nil && host.USBDevices[usbpath].Reserved
+		if !wasReserved && fresh.USBDevices[usbpath].Reserved {
+			changes = append(changes, Change{Type: USBReserved, Node: fresh.Name, VMID: fresh.USBHolder(usbpath), Device: DeviceBus(usbpath)})
+		}
+	}
+	for _, usbpath := range slices.Sorted(maps.Keys(host.USBDevices)) {
+		isReserved := fresh.USBDevices[usbpath] != nil && fresh.USBDevices[usbpath].Reserved
+		if host.USBDevices[usbpath].Reserved && !isReserved {
+			changes = append(changes, Change{Type: USBReleased, Node: host.Name, VMID: host.USBHolder(usbpath), Device: DeviceBus(usbpath)})
+		}
+	}
+
+	return changes
+}
+
+// get the vmid of the first instance a device is assigned to, or 0 if it is not assigned
+//
+// devices reserved only through their iommu group are held by the instance holding a function in the same group
+func (host *Node) DeviceHolder(bus DeviceBus) InstanceID {
+	if vmid := host.directHolder(bus); vmid != 0 {
+		return vmid
+	}
+	device, ok := host.Devices[bus]
+	if !ok || !device.Group_Reserved {
+		return 0
+	}
+	groups := device.IOMMUGroups()
+	for _, peer := range slices.Sorted(maps.Keys(host.Devices)) {
+		if peer == bus {
+			continue
+		}
+		for _, function := range host.Devices[peer].Functions {
+			if function.Reserved && !function.Group_Reserved && slices.Contains(groups, function.IOMMU_Group) {
+				if vmid := host.directHolder(peer); vmid != 0 {
+					return vmid
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// get the vmid of the first instance a device is attributed to, or 0 if it is not attributed to any instance
+func (host *Node) directHolder(bus DeviceBus) InstanceID {
+	for _, assignment := range host.DeviceAssignments() {
+		if assignment.Bus == bus {
+			return assignment.VMID
+		}
+	}
+	return 0
+}
+
+// a node device, or some of its functions, attributed to a pci entry of an instance
+type DeviceAssignment struct {
+	VMID      InstanceID
+	Device    DeviceID // instance config key, eg: hostpci0
+	Bus       DeviceBus
+	Functions []FunctionID // functions passed through, none for mediated devices
+	Mdev_Type string
+}
+
+// get the node device each pci entry of the node's instances is attributed to, sorted by vmid and config key
+//
+// devices assigned by bus id are attributed first, then each device assigned through a mapping is attributed to the first device of the mapping
+// whose functions are not attributed yet, the same way PVE picks a free mapped device when the guest starts,
+// if every mapped device is taken the first one is used
+func (host *Node) DeviceAssignments() []DeviceAssignment {
+	assignments := []DeviceAssignment{}
+	taken := map[DeviceBus]map[FunctionID]bool{}
+	take := func(bus DeviceBus, functions []FunctionID) {
+		if taken[bus] == nil {
+			taken[bus] = map[FunctionID]bool{}
+		}
+		for _, functionid := range functions {
+			taken[bus][functionid] = true
+		}
+	}
+
+	type mappedDevice struct {
+		vmid     InstanceID
+		deviceid DeviceID
+		device   *Device
+	}
+	mapped := []mappedDevice{}
+	for _, vmid := range slices.Sorted(maps.Keys(host.Instances)) {
+		instance := host.Instances[vmid]
+		for _, deviceid := range slices.Sorted(maps.Keys(instance.Devices)) {
+			instanceDevice := instance.Devices[deviceid]
+			if instanceDevice.Mapping != "" {
+				mapped = append(mapped, mappedDevice{vmid, deviceid, instanceDevice})
+				continue
+			}
+			hostDevice, ok := host.Devices[instanceDevice.Device_Bus]
+			if !ok {
+				continue
+			}
+			assignment := DeviceAssignment{VMID: vmid, Device: deviceid, Bus: instanceDevice.Device_Bus, Functions: []FunctionID{}, Mdev_Type: instanceDevice.Mdev_Type}
+			for _, functionid := range slices.Sorted(maps.Keys(instanceDevice.Functions)) {
+				if _, ok := hostDevice.Functions[functionid]; ok && instanceDevice.Functions[functionid].Reserved {
+					assignment.Functions = append(assignment.Functions, functionid)
+				}
+			}
+			take(assignment.Bus, assignment.Functions)
+			assignments = append(assignments, assignment)
+		}
+	}
+
+	for _, entry := range mapped {
+		busIDs, err := host.ResolveMapping(entry.device.Mapping)
 		if err != nil {
-			return err
+			continue
+		}
+		candidates := []DeviceAssignment{}
+		for _, busID := range busIDs {
+			x := strings.Split(string(busID), ".")
+			hostDevice, ok := host.Devices[DeviceBus(x[0])]
+			if !ok {
+				continue
+			}
+			candidate := DeviceAssignment{VMID: entry.vmid, Device: entry.deviceid, Bus: DeviceBus(x[0]), Functions: []FunctionID{}, Mdev_Type: entry.device.Mdev_Type}
+			if candidate.Mdev_Type == "" {
+				if len(x) == 2 {
+					if _, ok := hostDevice.Functions[FunctionID(x[1])]; ok {
+						candidate.Functions = append(candidate.Functions, FunctionID(x[1]))
+					}
+				} else {
+					candidate.Functions = slices.Sorted(maps.Keys(hostDevice.Functions))
+				}
+			}
+			candidates = append(candidates, candidate)
+		}
+		if len(candidates) == 0 {
+			continue
 		}
+		chosen := candidates[0]
+		if chosen.Mdev_Type == "" { // mediated devices are slices and do not take the device
+			for _, candidate := range candidates {
+				free := true
+				for _, functionid := range candidate.Functions {
+					free = free && !taken[candidate.Bus][functionid]
+				}
+				if free {
+					chosen = candidate
+					break
+				}
+			}
+		}
+		take(chosen.Bus, chosen.Functions)
+		assignments = append(assignments, chosen)
 	}
 
-	// check node device reserved by iterating over each function, we will assume that a single reserved function means the device is also reserved
+	slices.SortFunc(assignments, func(a DeviceAssignment, b DeviceAssignment) int {
+		return cmp.Or(cmp.Compare(a.VMID, b.VMID), strings.Compare(string(a.Device), string(b.Device)))
+	})
+	return assignments
+}
+
+// checks if a device is assigned to an instance in PVE, either passed through or sliced into mediated devices, which can not be passed through whole
+func (device *Device) Assigned() bool {
+	return device.Reserved || device.MdevAssigned() > 0
+}
+
+// get the number of instances assigned a mediated device of the device
+func (device *Device) MdevAssigned() int {
+	assigned := 0
+	for _, mdevtype := range device.Mdev_Types {
+		assigned += mdevtype.Assigned
+	}
+	return assigned
+}
+
+// get the sorted iommu groups of the functions of a device, functions which are not in an iommu group are skipped
+func (device *Device) IOMMUGroups() []int {
+	groups := []int{}
+	for _, function := range device.Functions {
+		if function.IOMMU_Group >= 0 && !slices.Contains(groups, function.IOMMU_Group) {
+			groups = append(groups, function.IOMMU_Group)
+		}
+	}
+	slices.Sort(groups)
+	return groups
+}
+
+// get the sorted iommu groups of the functions of a set of node devices
+func (host *Node) IOMMUGroups(buses map[DeviceBus]bool) []int {
+	groups := []int{}
+	for bus := range buses {
+		if device, ok := host.Devices[bus]; ok {
+			for _, group := range device.IOMMUGroups() {
+				if !slices.Contains(groups, group) {
+					groups = append(groups, group)
+				}
+			}
+		}
+	}
+	slices.Sort(groups)
+	return groups
+}
+
+// checks if a device is free to be passed through, it must not be assigned in PVE, held by a pending reservation,
+// or share an iommu group with a held device
+func (host *Node) DeviceFree(device *Device, held map[DeviceBus]bool) bool {
+	if device.Assigned() || held[device.Device_Bus] {
+		return false
+	}
+	heldGroups := host.IOMMUGroups(held)
+	for _, group := range device.IOMMUGroups() {
+		if slices.Contains(heldGroups, group) {
+			return false
+		}
+	}
+	return true
+}
+
+// get the devices of a node held by pending reservations
+func PendingDevices(hostName string, pending []*Reservation) map[DeviceBus]bool {
+	held := map[DeviceBus]bool{}
+	for _, reservation := range pending {
+		if reservation.Node == hostName {
+			for _, device := range reservation.Devices {
+				held[device.Device_Bus] = true
+			}
+		}
+	}
+	return held
+}
+
+// get the vmid of the instance a usb device is attributed to, or 0 if it is not assigned
+func (host *Node) USBHolder(usbpath string) InstanceID {
+	return host.USBAssignments()[usbpath]
+}
+
+// get the instance each plugged in usb device is attributed to
+//
+// devices assigned by port are attributed first, then each device assigned by vendor:product id is attributed to the first matching port
+// which is not attributed yet, the same way QEMU picks a free matching device when the guest starts
+func (host *Node) USBAssignments() map[string]InstanceID {
+	assigned := map[string]InstanceID{}
+	vmids := slices.Sorted(maps.Keys(host.Instances))
+	for _, vmid := range vmids {
+		instance := host.Instances[vmid]
+		for _, usbid := range slices.Sorted(maps.Keys(instance.USBDevices)) {
+			usbpath := instance.USBDevices[usbid].USB_Path
+			if _, ok := assigned[usbpath]; !ok && host.USBDevices[usbpath] != nil {
+				assigned[usbpath] = vmid
+			}
+		}
+	}
+	for _, vmid := range vmids {
+		instance := host.Instances[vmid]
+		for _, usbid := range slices.Sorted(maps.Keys(instance.USBDevices)) {
+			usbdevice := instance.USBDevices[usbid]
+			if usbdevice.USB_Path != "" || usbdevice.Vendor_ID == "" {
+				continue
+			}
+			for _, found := range host.FindUSBDevices(usbdevice.Vendor_ID + ":" + usbdevice.Product_ID) {
+				if _, ok := assigned[found.USB_Path]; !ok {
+					assigned[found.USB_Path] = vmid
+					break
+				}
+			}
+		}
+	}
+	return assigned
+}
+
+// compares the node level resources of two nodes, instances and status are not compared
+func (host *Node) Equal(other *Node) bool {
+	return host.Name == other.Name &&
+		host.Cores == other.Cores &&
+		host.Memory == other.Memory &&
+		host.Swap == other.Swap &&
+		slices.Equal(host.Proctypes, other.Proctypes) &&
+		reflect.DeepEqual(host.Devices, other.Devices) &&
+		reflect.DeepEqual(host.USBDevices, other.USBDevices) &&
+		reflect.DeepEqual(host.Storages, other.Storages)
+}
+
+// compares the node level resources of two nodes ignoring live usage, storage usage and mdev counts change on almost every sync
+// so they are published without a change
+func (host *Node) EqualResources(other *Node) bool {
+	return withoutUsage(host).Equal(withoutUsage(other))
+}
+
+// copies a node without its storage usage and mdev counts
+func withoutUsage(host *Node) *Node {
+	stripped := *host
+	stripped.Storages = make(map[string]*Storage, len(host.Storages))
+	for storageName, storage := range host.Storages {
+		s := *storage
+		s.Used = 0
+		stripped.Storages[storageName] = &s
+	}
+	stripped.Devices = make(map[DeviceBus]*Device, len(host.Devices))
+	for bus, device := range host.Devices {
+		d := device.Clone()
+		for _, mdevtype := range d.Mdev_Types {
+			mdevtype.Available = 0
+			mdevtype.Assigned = 0
+			mdevtype.Remaining = 0
+		}
+		stripped.Devices[bus] = d
+	}
+	return &stripped
+}
+
+// copies a node so that it can be modified without affecting published snapshots
+//
+// devices are deep copied because reservations are recomputed in place, instances are shared until replaced
+func (host *Node) Clone() *Node {
+	clone := *host
+	clone.Instances = maps.Clone(host.Instances)
+	clone.Devices = make(map[DeviceBus]*Device, len(host.Devices))
+	for bus, device := range host.Devices {
+		clone.Devices[bus] = device.Clone()
+	}
+	clone.USBDevices = make(map[string]*USBDevice, len(host.USBDevices))
+	for usbpath, usbdevice := range host.USBDevices {
+		u := *usbdevice
+		clone.USBDevices[usbpath] = &u
+	}
+	return &clone
+}
+
+// marks every device function assigned to an instance as reserved, every function sharing an iommu group with a reserved function as reserved,
+// and every device with a reserved function as reserved
+func (host *Node) RebuildReservations() {
 	for _, device := range host.Devices {
-		reserved := false
 		for _, function := range device.Functions {
-			reserved = reserved || function.Reserved
+			function.Reserved = false
+			function.Group_Reserved = false
 		}
-		device.Reserved = reserved
 	}
 
-	return nil
-}
+	assignments := host.DeviceAssignments()
+	for _, assignment := range assignments {
+		for _, functionid := range assignment.Functions {
+			host.Devices[assignment.Bus].Functions[functionid].Reserved = true
+		}
+	}
 
-func (host *Node) GetInstance(vmid uint) (*Instance, error) {
-	instance_ch := make(chan *Instance)
-	err_ch := make(chan error)
-
-	go func() {
-		// aquire host lock
-		host.lock.Lock()
-		defer host.lock.Unlock()
-		// get instance
-		instance, ok := host.Instances[InstanceID(vmid)]
-		if !ok {
-			instance_ch <- nil
-			err_ch <- fmt.Errorf("vmid %d not in host %s", vmid, host.Name)
-		} else {
-			// aquire instance lock to wait in case of a concurrent write
-			instance.lock.Lock()
-			defer instance.lock.Unlock()
+	// passing a function through makes every other function in its iommu group unusable, so those are reserved as well
+	reservedGroups := []int{}
+	for _, device := range host.Devices {
+		for _, function := range device.Functions {
+			if function.Reserved && function.IOMMU_Group >= 0 {
+				reservedGroups = append(reservedGroups, function.IOMMU_Group)
+			}
+		}
+	}
+	for _, device := range host.Devices {
+		for _, function := range device.Functions {
+			if !function.Reserved && slices.Contains(reservedGroups, function.IOMMU_Group) {
+				function.Reserved = true
+				function.Group_Reserved = true
+			}
+		}
+	}
 
-			instance_ch <- instance
-			err_ch <- nil
+	// check node device reserved by iterating over each function, we will assume that a single reserved function means the device is also reserved
+	// and mark the device as partially reserved if some of its functions are still free
+	for _, device := range host.Devices {
+		reserved := 0
+		direct := 0
+		for _, function := range device.Functions {
+			if function.Reserved {
+				reserved++
+			}
+			if function.Reserved && !function.Group_Reserved {
+				direct++
+			}
 		}
-	}()
+		device.Reserved = reserved > 0
+		device.Group_Reserved = reserved > 0 && direct == 0
+		device.Partial = reserved > 0 && reserved < len(device.Functions)
+	}
 
-	instance := <-instance_ch
-	err := <-err_ch
-	return instance, err
+	// count the instances assigned each mdev type, instances which are not running have not created their mediated device yet
+	for _, device := range host.Devices {
+		for _, mdevtype := range device.Mdev_Types {
+			mdevtype.Assigned = 0
+			mdevtype.Remaining = mdevtype.Available
+		}
+	}
+	for _, assignment := range assignments {
+		if assignment.Mdev_Type == "" {
+			continue
+		}
+		if mdevtype, ok := host.Devices[assignment.Bus].Mdev_Types[assignment.Mdev_Type]; ok {
+			mdevtype.Assigned++
+			if host.Instances[assignment.VMID].Status != "running" {
+				mdevtype.Remaining = max(mdevtype.Remaining-1, 0)
+			}
+		}
+	}
+
+	// usb devices are reserved while they are attributed to any instance
+	for _, usbdevice := range host.USBDevices {
+		usbdevice.Reserved = false
+	}
+	for usbpath := range host.USBAssignments() {
+		host.USBDevices[usbpath].Reserved = true
+	}
 }
 
-func (host *Node) RebuildInstance(instancetype InstanceType, vmid uint) error {
+func (host *Node) GetInstance(vmid uint) (*Instance, error) {
+	instance, ok := host.Instances[InstanceID(vmid)]
+	if !ok {
+		return nil, fmt.Errorf("vmid %d not in host %s", vmid, host.Name)
+	}
+	return instance, nil
+}
+
+// builds a complete instance from PVE and links it against the host's devices without adding it to the host
+//
+// if the fetched config digest matches the previous instance's digest, the previous volumes, nets, devices and boot order are reused
+// instead of being parsed again, returns true if they were rebuilt
+func (host *Node) BuildInstance(ctx context.Context, resource *proxmox.ClusterResource, previous *Instance) (*Instance, bool, error) {
+	instancetype := ResourceInstanceType(resource)
+	vmid := uint(resource.VMID)
+
 	var instance *Instance
 	if instancetype == VM {
 		var err error
-		instance, err = host.VirtualMachine(vmid)
+		instance, err = host.VirtualMachine(ctx, vmid)
 		if err != nil {
-			return fmt.Errorf("error retrieving %d: %s, possibly down?", vmid, err.Error())
+			return nil, false, fmt.Errorf("error retrieving %d: %s, possibly down?", vmid, err.Error())
 		}
 	} else if instancetype == CT {
 		var err error
-		instance, err = host.Container(vmid)
+		instance, err = host.Container(ctx, vmid)
 		if err != nil {
-			return fmt.Errorf("error retrieving %d: %s, possibly down?", vmid, err.Error())
+			return nil, false, fmt.Errorf("error retrieving %d: %s, possibly down?", vmid, err.Error())
 		}
 
 	}
 
-	// aquire lock on instance, release on return
-	instance.lock.Lock()
-	defer instance.lock.Unlock()
+	rebuilt := previous == nil || previous.Type != instance.Type || previous.Digest != instance.Digest
+	if rebuilt {
+		for volid := range instance.configDisks {
+			instance.RebuildVolume(ctx, host, volid)
+		}
 
-	host.Instances[InstanceID(vmid)] = instance
+		for netid := range instance.configNets {
+			instance.RebuildNet(netid)
+		}
 
-	for volid := range instance.configDisks {
-		instance.RebuildVolume(host, volid)
-	}
+		for deviceid := range instance.configHostPCIs {
+			instance.RebuildDevice(host, deviceid)
+		}
 
-	for netid := range instance.configNets {
-		instance.RebuildNet(netid)
+		for usbid := range instance.configUSBs {
+			instance.RebuildUSB(host, usbid)
+		}
+
+		if instance.Type == VM {
+			instance.RebuildBoot()
+		}
+	} else { // config is unchanged, reuse the previously parsed state
+		instance.Volumes = previous.Volumes
+		instance.Nets = previous.Nets
+		instance.Devices = previous.Devices
+		instance.USBDevices = previous.USBDevices
+		instance.Boot = previous.Boot
+
+		// mapped entries depend on the mappings, which can change without the config changing, so they are always linked again
+		if instance.HasMappedDevices() {
+			instance.Devices = make(map[DeviceID]*Device)
+			for deviceid := range instance.configHostPCIs {
+				instance.RebuildDevice(host, deviceid)
+			}
+			instance.USBDevices = make(map[DeviceID]*USBDevice)
+			for usbid := range instance.configUSBs {
+				instance.RebuildUSB(host, usbid)
+			}
+		}
 	}
 
-	for deviceid := range instance.configHostPCIs {
-		instance.RebuildDevice(host, deviceid)
+	instance.Status = resource.Status
+	instance.Pool = resource.Pool
+	instance.Tags = []string{}
+	if resource.Tags != "" {
+		instance.Tags = strings.Split(resource.Tags, ";")
 	}
+	instance.resourceState = ResourceState(resource)
+
+	return instance, rebuilt, nil
+}
 
-	if instance.Type == VM {
-		instance.RebuildBoot()
+// checks if any pci or usb entry of the instance config references a resource mapping
+func (instance *Instance) HasMappedDevices() bool {
+	for _, entry := range instance.configHostPCIs {
+		if _, ok := PVEObjectStringToMap(entry)["mapping"]; ok {
+			return true
+		}
 	}
+	for _, entry := range instance.configUSBs {
+		if _, ok := PVEObjectStringToMap(entry)["mapping"]; ok {
+			return true
+		}
+	}
+	return false
+}
 
-	return nil
+// compares the exported state of two instances
+func (instance *Instance) Equal(other *Instance) bool {
+	return instance.Type == other.Type &&
+		instance.Digest == other.Digest &&
+		instance.Name == other.Name &&
+		instance.Status == other.Status &&
+		instance.Pool == other.Pool &&
+		slices.Equal(instance.Tags, other.Tags) &&
+		instance.Proctype == other.Proctype &&
+		instance.Cores == other.Cores &&
+		instance.Memory == other.Memory &&
+		instance.Swap == other.Swap &&
+		reflect.DeepEqual(instance.Volumes, other.Volumes) &&
+		reflect.DeepEqual(instance.Nets, other.Nets) &&
+		reflect.DeepEqual(instance.Devices, other.Devices) &&
+		reflect.DeepEqual(instance.USBDevices, other.USBDevices) &&
+		reflect.DeepEqual(instance.Boot, other.Boot)
 }
 
-func (instance *Instance) RebuildVolume(host *Node, volid string) error {
+func (instance *Instance) RebuildVolume(ctx context.Context, host *Node, volid string) error {
 	volumeDataString := instance.configDisks[volid]
 
-	volume, err := GetVolumeInfo(host, volumeDataString)
+	volume, err := GetVolumeInfo(ctx, host, volumeDataString)
 	if err != nil {
 		return err
 	}
@@ -221,24 +1249,164 @@ func (instance *Instance) RebuildDevice(host *Node, deviceid string) error {
 		return fmt.Errorf("%s not found in devices", deviceid)
 	}
 
-	hostDeviceBusID := DeviceID(strings.Split(instanceDevice, ",")[0])
+	hostDeviceBusID := NormalizeDeviceBusID(DeviceID(strings.Split(instanceDevice, ",")[0]))
 	instanceDeviceBusID := DeviceID(deviceid)
 
+	// mapped devices reference a cluster resource mapping instead of a bus id
+	mappingName, mapped := PVEObjectStringToMap(instanceDevice)["mapping"]
+	if mapped { // the first mapped device is used as a template, the device the instance holds is attributed by the node
+		busIDs, err := host.ResolveMapping(mappingName)
+		if err != nil {
+			return err
+		}
+		hostDeviceBusID = busIDs[0]
+	}
+
 	if DeviceBusIDIsSuperDevice(hostDeviceBusID) {
-		instance.Devices[DeviceID(instanceDeviceBusID)] = host.Devices[DeviceBus(hostDeviceBusID)]
+		hostDevice, ok := host.Devices[DeviceBus(hostDeviceBusID)]
+		if !ok {
+			return fmt.Errorf("%s not found in host %s devices", hostDeviceBusID, host.Name)
+		}
+		// instances hold their own copy of the device so that the host's devices are only changed by RebuildReservations
+		instance.Devices[DeviceID(instanceDeviceBusID)] = hostDevice.Clone()
 		for _, function := range instance.Devices[DeviceID(instanceDeviceBusID)].Functions {
 			function.Reserved = true
 		}
-	} else {
-		// sub function assignment not supported yet
+		instance.Devices[DeviceID(instanceDeviceBusID)].Reserved = true
+		instance.Devices[DeviceID(instanceDeviceBusID)].Partial = false
+	} else { // sub function assignment, only the assigned function is linked and reserved
+		x := strings.Split(string(hostDeviceBusID), ".")
+		bus := DeviceBus(x[0])
+		functionid := FunctionID(x[1])
+		hostDevice, ok := host.Devices[bus]
+		if !ok {
+			return fmt.Errorf("%s not found in host %s devices", bus, host.Name)
+		}
+		if _, ok := hostDevice.Functions[functionid]; !ok {
+			return fmt.Errorf("function %s not found in host %s device %s", functionid, host.Name, bus)
+		}
+		device := hostDevice.Clone()
+		function := device.Functions[functionid]
+		function.Reserved = true
+		device.Functions = map[FunctionID]*Function{functionid: function}
+		device.Reserved = true
+		device.Partial = len(hostDevice.Functions) > 1
+		instance.Devices[DeviceID(instanceDeviceBusID)] = device
 	}
 
+	// the instance's copy only reflects its own assignment, group reservations belong to the host's devices
+	instance.Devices[DeviceID(instanceDeviceBusID)].Group_Reserved = false
+	for _, function := range instance.Devices[DeviceID(instanceDeviceBusID)].Functions {
+		function.Group_Reserved = false
+	}
+
+	// mediated devices are slices of the host device, so neither the device nor its functions are reserved by the instance
+	// the instance's copy does not keep the host's mdev types because their counts change whenever any instance starts or stops
+	instance.Devices[DeviceID(instanceDeviceBusID)].Mdev_Types = nil
+	if mdevType, ok := PVEObjectStringToMap(instanceDevice)["mdev"]; ok {
+		device := instance.Devices[DeviceID(instanceDeviceBusID)]
+		device.Mdev_Type = mdevType
+		device.Reserved = false
+		device.Partial = false
+		for _, function := range device.Functions {
+			function.Reserved = false
+		}
+	}
+
+	if mapped {
+		instance.Devices[DeviceID(instanceDeviceBusID)].Mapping = mappingName
+		instance.Devices[DeviceID(instanceDeviceBusID)].Device_Bus = ""
+	}
 	instance.Devices[DeviceID(instanceDeviceBusID)].Device_ID = DeviceID(deviceid)
 	instance.Devices[DeviceID(instanceDeviceBusID)].Value = instanceDevice
 
 	return nil
 }
 
+// links a usb entry (eg: host=046d:c52b, host=1-2.3 or mapping=dongle) to the host's usb device
+//
+// entries whose device is not plugged in, and spice redirections, are kept without a host device
+func (instance *Instance) RebuildUSB(host *Node, usbid string) error {
+	instanceUSB, ok := instance.configUSBs[usbid]
+	if !ok { // if device does not exist
+		return fmt.Errorf("%s not found in usb devices", usbid)
+	}
+
+	usbObj := PVEObjectStringToMap(instanceUSB)
+	hostUSB := usbObj["host"]
+	mappingName, mapped := usbObj["mapping"]
+	if mapped {
+		if host.mappings == nil || host.mappings.USB[mappingName] == nil || len(host.mappings.USB[mappingName].Nodes[host.Name]) == 0 {
+			return fmt.Errorf("usb mapping %s has no devices on host %s", mappingName, host.Name)
+		}
+		hostUSB = host.mappings.USB[mappingName].Nodes[host.Name][0]
+	}
+
+	usbdevice := &USBDevice{}
+	if found := host.FindUSBDevices(hostUSB); len(found) > 0 {
+		*usbdevice = *found[0]
+	}
+	// devices assigned by vendor:product id are not tied to a port, the port is attributed by the node in USBAssignments
+	// devices assigned by port keep the port even if nothing is plugged in, so they are attributed once a device is plugged in
+	if vendor, product, ok := strings.Cut(hostUSB, ":"); ok {
+		usbdevice.USB_Path = ""
+		usbdevice.Serial = ""
+		usbdevice.Vendor_ID = NormalizeHexID(vendor)
+		usbdevice.Product_ID = NormalizeHexID(product)
+	} else if hostUSB != "" && hostUSB != "spice" {
+		usbdevice.USB_Path = hostUSB
+	}
+	usbdevice.USB_ID = DeviceID(usbid)
+	usbdevice.Reserved = true
+	if mapped {
+		usbdevice.Mapping = mappingName
+	}
+	usbdevice.Value = instanceUSB
+	instance.USBDevices[DeviceID(usbid)] = usbdevice
+
+	return nil
+}
+
+// get the plugged in usb devices matching a port path or every plugged in device matching a vendor:product id, sorted by port path
+func (host *Node) FindUSBDevices(hostUSB string) []*USBDevice {
+	found := []*USBDevice{}
+	if hostUSB == "" {
+		return found
+	}
+	vendor, product, byID := strings.Cut(hostUSB, ":")
+	if !byID {
+		if usbdevice, ok := host.USBDevices[hostUSB]; ok {
+			found = append(found, usbdevice)
+		}
+		return found
+	}
+	for _, usbpath := range slices.Sorted(maps.Keys(host.USBDevices)) {
+		usbdevice := host.USBDevices[usbpath]
+		if usbdevice.Vendor_ID == NormalizeHexID(vendor) && usbdevice.Product_ID == NormalizeHexID(product) {
+			found = append(found, usbdevice)
+		}
+	}
+	return found
+}
+
+// copies a device and its functions
+func (device *Device) Clone() *Device {
+	clone := *device
+	clone.Functions = make(map[FunctionID]*Function, len(device.Functions))
+	for functionid, function := range device.Functions {
+		f := *function
+		clone.Functions[functionid] = &f
+	}
+	if device.Mdev_Types != nil {
+		clone.Mdev_Types = make(map[string]*MdevType, len(device.Mdev_Types))
+		for mdevtype, t := range device.Mdev_Types {
+			m := *t
+			clone.Mdev_Types[mdevtype] = &m
+		}
+	}
+	return &clone
+}
+
 func (instance *Instance) RebuildBoot() {
 	instance.Boot = BootOrder{}
 
@@ -271,7 +1439,8 @@ func (instance *Instance) RebuildBoot() {
 		}
 	}
 
-	for bootTarget, isEligible := range eligibleBoot { // iterate over remaining items, add them to Disabled
+	for _, bootTarget := range slices.Sorted(maps.Keys(eligibleBoot)) { // iterate over remaining items in a stable order, add them to Disabled
+		isEligible := eligibleBoot[bootTarget]
 		if val, ok := instance.Volumes[VolumeID(bootTarget)]; ok && isEligible { // if the item is eligible and is in volumes
 			instance.Boot.Disabled = append(instance.Boot.Disabled, val)
 		} else if val, ok := instance.Nets[NetID(bootTarget)]; ok && isEligible { // if the item is eligible and is in nets
@@ -281,3 +1450,45 @@ func (instance *Instance) RebuildBoot() {
 		}
 	}
 }
+
+func NewSyncStats() *SyncStats {
+	return &SyncStats{
+		Started: time.Now(),
+		Changes: []Change{},
+	}
+}
+
+// counts an instance that was built from a fetched config, rebuilt is true if its config was parsed and false if its digest was unchanged
+func (stats *SyncStats) Count(rebuilt bool) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	if rebuilt {
+		stats.Rebuilt++
+	} else {
+		stats.Skipped++
+	}
+}
+
+// counts an instance that was reused without fetching its config because its /cluster/resources state was unchanged
+func (stats *SyncStats) CountReused() {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.Reused++
+}
+
+// summarizes the number of changes of each type, eg: "2 instance_added, 1 node_updated"
+func (stats *SyncStats) String() string {
+	instances := fmt.Sprintf("%d rebuilt, %d skipped, %d reused", stats.Rebuilt, stats.Skipped, stats.Reused)
+	if len(stats.Changes) == 0 {
+		return instances + ", no changes"
+	}
+	counts := map[ChangeType]int{}
+	for _, change := range stats.Changes {
+		counts[change.Type]++
+	}
+	summary := []string{}
+	for _, changeType := range slices.Sorted(maps.Keys(counts)) {
+		summary = append(summary, fmt.Sprintf("%d %s", counts[changeType], changeType))
+	}
+	return instances + ", " + strings.Join(summary, ", ")
+}
@@ -0,0 +1,175 @@
+package app
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// scores a node which can host a placement, nodes with higher scores are preferred
+type PlacementStrategy func(capacity *NodeCapacity, demand Demand) float64
+
+const DefaultPlacementStrategy = "least-loaded"
+
+var PlacementStrategies = map[string]PlacementStrategy{
+	"binpack":      BinPack,
+	"spread":       Spread,
+	"least-loaded": LeastLoaded,
+}
+
+// a proposed new instance to find a node for
+type PlacementRequest struct {
+	Type        InstanceType      `json:"type"` // VM or CT, selects storages which can hold images or rootdirs
+	Cores       uint64            `json:"cores"`
+	Memory      uint64            `json:"memory"`
+	Swap        uint64            `json:"swap"`
+	Disk        uint64            `json:"disk"`         // bytes
+	Storage     string            `json:"storage"`      // storage name, optional
+	StorageType string            `json:"storage_type"` // PVE storage plugin type, optional
+	CPU         string            `json:"cpu"`          // required cpu type, optional
+	Devices     []AdmissionDevice `json:"devices"`
+	Strategy    string            `json:"strategy"` // binpack, spread or least-loaded
+}
+
+type PlacementCandidate struct {
+	Node    string  `json:"node"`
+	Score   float64 `json:"score"`
+	Storage string  `json:"storage,omitempty"` // storage chosen for the disk
+}
+
+type PlacementRejection struct {
+	Node    string   `json:"node"`
+	Reasons []string `json:"reasons"`
+}
+
+type PlacementResult struct {
+	Strategy   string               `json:"strategy"`
+	Candidates []PlacementCandidate `json:"candidates"` // best first
+	Rejected   []PlacementRejection `json:"rejected"`
+}
+
+// prefers the fullest nodes so that other nodes stay free for large instances
+func BinPack(capacity *NodeCapacity, demand Demand) float64 {
+	return Utilization(capacity, demand)
+}
+
+// prefers the emptiest nodes by resource usage
+func LeastLoaded(capacity *NodeCapacity, demand Demand) float64 {
+	return 1 - Utilization(capacity, demand)
+}
+
+// prefers nodes with the fewest instances
+func Spread(capacity *NodeCapacity, demand Demand) float64 {
+	return -float64(capacity.Instances)
+}
+
+// get the mean of the core and memory usage of a node against its budget once a demand is placed on it
+func Utilization(capacity *NodeCapacity, demand Demand) float64 {
+	cores := Ratio(capacity.Cores.Allocated+capacity.Cores.Reserved+uint64(max(demand.Cores, 0)), capacity.Cores.Budget)
+	memory := Ratio(capacity.Memory.Allocated+capacity.Memory.Reserved+uint64(max(demand.Memory, 0)), capacity.Memory.Budget)
+	return (cores + memory) / 2
+}
+
+// ranks the nodes which can host a proposed instance, and explains why the other nodes cannot
+func (snapshot *Snapshot) Place(request PlacementRequest, pending []*Reservation, overcommit OvercommitConfig) (*PlacementResult, error) {
+	if request.Strategy == "" {
+		request.Strategy = DefaultPlacementStrategy
+	}
+	strategy, ok := PlacementStrategies[request.Strategy]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a valid placement strategy (%s)", request.Strategy, StrategyNames())
+	}
+
+	result := PlacementResult{
+		Strategy:   request.Strategy,
+		Candidates: []PlacementCandidate{},
+		Rejected:   []PlacementRejection{},
+	}
+
+	for _, hostName := range slices.Sorted(maps.Keys(snapshot.Nodes)) {
+		host := snapshot.Nodes[hostName]
+		reasons := []string{}
+
+		if request.CPU != "" && !slices.Contains(host.Proctypes, request.CPU) {
+			reasons = append(reasons, fmt.Sprintf("cpu type %s is not supported", request.CPU))
+		}
+
+		demand := NewDemand()
+		demand.Cores = int64(request.Cores)
+		demand.Memory = int64(request.Memory)
+		demand.Swap = int64(request.Swap)
+		for _, device := range request.Devices {
+			demand.Devices[device.Device_Name] += max(device.Count, 1)
+		}
+
+		storageName := ""
+		if request.Disk > 0 || request.Storage != "" || request.StorageType != "" {
+			var reason string
+			storageName, reason = host.ChooseStorage(request)
+			if storageName == "" {
+				reasons = append(reasons, reason)
+			} else {
+				demand.Disk[storageName] = int64(request.Disk)
+			}
+		}
+
+		for _, check := range snapshot.CheckNode(host, demand, pending, overcommit) {
+			if !check.Allowed {
+				reasons = append(reasons, check.Reason)
+			}
+		}
+
+		if len(reasons) > 0 {
+			result.Rejected = append(result.Rejected, PlacementRejection{Node: hostName, Reasons: reasons})
+			continue
+		}
+		capacity := snapshot.NodeCapacity(host, pending, overcommit)
+		result.Candidates = append(result.Candidates, PlacementCandidate{Node: hostName, Score: strategy(capacity, demand), Storage: storageName})
+	}
+
+	slices.SortStableFunc(result.Candidates, func(a PlacementCandidate, b PlacementCandidate) int {
+		return cmp.Compare(b.Score, a.Score)
+	})
+
+	return &result, nil
+}
+
+// picks the active storage with the most free space which matches the requested storage name, type and content,
+// or returns the reason no storage matched
+func (host *Node) ChooseStorage(request PlacementRequest) (string, string) {
+	content := ""
+	switch request.Type {
+	case VM:
+		content = "images"
+	case CT:
+		content = "rootdir"
+	}
+
+	chosen := ""
+	free := uint64(0)
+	for _, storageName := range slices.Sorted(maps.Keys(host.Storages)) {
+		storage := host.Storages[storageName]
+		if !storage.Active ||
+			(request.Storage != "" && storageName != request.Storage) ||
+			(request.StorageType != "" && storage.Type != request.StorageType) ||
+			(content != "" && !slices.Contains(storage.Content, content)) {
+			continue
+		}
+		if available := storage.Size - min(storage.Used, storage.Size); chosen == "" || available > free {
+			chosen = storageName
+			free = available
+		}
+	}
+
+	if chosen == "" {
+		return "", fmt.Sprintf("no active storage matches name %q, type %q and content %q", request.Storage, request.StorageType, content)
+	}
+	return chosen, ""
+}
+
+// get the names of the placement strategies, eg: "binpack, least-loaded, spread"
+func StrategyNames() string {
+	return strings.Join(slices.Sorted(maps.Keys(PlacementStrategies)), ", ")
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"log"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -16,11 +18,50 @@ type ProxmoxClient struct {
 }
 
 type PVEDevice struct { // used only for requests to PVE
-	ID                    string `json:"id"`
-	Device_Name           string `json:"device_name"`
-	Vendor_Name           string `json:"vendor_name"`
-	Subsystem_Device_Name string `json:"subsystem_device_name"`
-	Subsystem_Vendor_Name string `json:"subsystem_vendor_name"`
+	ID                    string  `json:"id"`
+	Class                 string  `json:"class"`
+	Vendor                string  `json:"vendor"`
+	Device                string  `json:"device"`
+	IOMMUGroup            int     `json:"iommugroup"`
+	Mdev                  PVEBool `json:"mdev"`
+	Device_Name           string  `json:"device_name"`
+	Vendor_Name           string  `json:"vendor_name"`
+	Subsystem_Device_Name string  `json:"subsystem_device_name"`
+	Subsystem_Vendor_Name string  `json:"subsystem_vendor_name"`
+}
+
+type PVEMdevType struct { // used only for requests to PVE
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Available   int    `json:"available"`
+}
+
+// PVE returns booleans as either 0 and 1 or false and true
+type PVEBool bool
+
+func (b *PVEBool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "1", "true":
+		*b = true
+	case "0", "false", "", "null":
+		*b = false
+	default:
+		return fmt.Errorf("%s is not a boolean", data)
+	}
+	return nil
+}
+
+type PVEUSBDevice struct { // used only for requests to PVE
+	BusNum       int    `json:"busnum"`
+	Port         int    `json:"port"`
+	USBPath      string `json:"usbpath"`
+	Class        int    `json:"class"`
+	VendID       string `json:"vendid"`
+	ProdID       string `json:"prodid"`
+	Manufacturer string `json:"manufacturer"`
+	Product      string `json:"product"`
+	Serial       string `json:"serial"`
 }
 
 type PVEProctype struct {
@@ -29,6 +70,40 @@ type PVEProctype struct {
 	Vendor string
 }
 
+type PVEACL struct { // used only for requests to PVE
+	Path   string `json:"path"`
+	UGID   string `json:"ugid"`
+	Type   string `json:"type"`
+	RoleID string `json:"roleid"`
+}
+
+type PVEGroup struct { // used only for requests to PVE
+	GroupID string `json:"groupid"`
+	Users   string `json:"users"`
+}
+
+type PVEUser struct { // used only for requests to PVE
+	UserID string `json:"userid"`
+}
+
+type PVEPool struct { // used only for requests to PVE
+	PoolID  string `json:"poolid"`
+	Comment string `json:"comment"`
+}
+
+type PVEMapping struct { // used only for requests to PVE
+	ID          string   `json:"id"`
+	Description string   `json:"description"`
+	Map         []string `json:"map"`
+}
+
+type Inventory struct { // used only for requests to PVE
+	Nodes    map[string]*proxmox.ClusterResource            // keyed by node name
+	Guests   map[InstanceID]*proxmox.ClusterResource        // keyed by vmid
+	Storages map[string]map[string]*proxmox.ClusterResource // keyed by node name then storage name
+	Mappings *Mappings                                      // nil if the mappings could not be fetched
+}
+
 func NewClient(url string, token string, secret string) ProxmoxClient {
 	HTTPClient := http.Client{
 		Transport: &http.Transport{
@@ -47,8 +122,8 @@ func NewClient(url string, token string, secret string) ProxmoxClient {
 }
 
 // Gets and returns the PVE API version
-func (pve ProxmoxClient) Version() (proxmox.Version, error) {
-	version, err := pve.client.Version(context.Background())
+func (pve ProxmoxClient) Version(ctx context.Context) (proxmox.Version, error) {
+	version, err := pve.client.Version(ctx)
 	if err != nil {
 		return *version, err
 	}
@@ -56,8 +131,8 @@ func (pve ProxmoxClient) Version() (proxmox.Version, error) {
 }
 
 // Gets all Nodes names
-func (pve ProxmoxClient) Nodes() ([]string, error) {
-	nodes, err := pve.client.Nodes(context.Background())
+func (pve ProxmoxClient) Nodes(ctx context.Context) ([]string, error) {
+	nodes, err := pve.client.Nodes(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -70,23 +145,170 @@ func (pve ProxmoxClient) Nodes() ([]string, error) {
 	return names, nil
 }
 
+// Gets the node, guest and storage inventory of the entire cluster with a single request to /cluster/resources
+func (pve ProxmoxClient) Inventory(ctx context.Context) (*Inventory, error) {
+	inventory := Inventory{
+		Nodes:    make(map[string]*proxmox.ClusterResource),
+		Guests:   make(map[InstanceID]*proxmox.ClusterResource),
+		Storages: make(map[string]map[string]*proxmox.ClusterResource),
+	}
+
+	resources := proxmox.ClusterResources{}
+	err := pve.client.Get(ctx, "/cluster/resources", &resources)
+	if err != nil {
+		return &inventory, err
+	}
+
+	for _, resource := range resources {
+		switch resource.Type {
+		case "node":
+			inventory.Nodes[resource.Node] = resource
+		case "qemu", "lxc":
+			inventory.Guests[InstanceID(resource.VMID)] = resource
+		case "storage":
+			if _, ok := inventory.Storages[resource.Node]; !ok {
+				inventory.Storages[resource.Node] = make(map[string]*proxmox.ClusterResource)
+			}
+			inventory.Storages[resource.Node][resource.Storage] = resource
+		}
+	}
+
+	inventory.Mappings, err = pve.Mappings(ctx)
+	if err != nil { // callers keep their current mappings
+		log.Printf("Failed to retrieve resource mappings: %s", err.Error())
+		inventory.Mappings = nil
+	}
+
+	return &inventory, nil
+}
+
+// Gets the pci and usb resource mappings of the cluster, clusters without resource mappings (PVE 7 and earlier) have none
+func (pve ProxmoxClient) Mappings(ctx context.Context) (*Mappings, error) {
+	mappings := NewMappings()
+	for mappingType, target := range map[string]map[string]*Mapping{"pci": mappings.PCI, "usb": mappings.USB} {
+		pvemappings := []PVEMapping{}
+		err := pve.client.Get(ctx, fmt.Sprintf("/cluster/mapping/%s", mappingType), &pvemappings)
+		if IsNotImplemented(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, pvemapping := range pvemappings {
+			target[pvemapping.ID] = GetMappingInfo(pvemapping)
+		}
+	}
+	return mappings, nil
+}
+
+// checks if an error from PVE is a 404 or 501 response, which PVE returns for api paths it does not have
+func IsNotImplemented(err error) bool {
+	if err == nil {
+		return false
+	}
+	return strings.HasPrefix(err.Error(), "404") || strings.HasPrefix(err.Error(), "501")
+}
+
+// Gets the pools and users of the cluster, and the instances and pools granted to each user by the ACL
+func (pve ProxmoxClient) Access(ctx context.Context) (*Access, error) {
+	access := NewAccess()
+
+	pools := []PVEPool{}
+	err := pve.client.Get(ctx, "/pools", &pools)
+	if err != nil {
+		return access, err
+	}
+	for _, pool := range pools {
+		access.Pools[pool.PoolID] = &Pool{Pool: pool.PoolID, Comment: pool.Comment}
+	}
+
+	users := []PVEUser{}
+	err = pve.client.Get(ctx, "/access/users", &users)
+	if err != nil {
+		return access, err
+	}
+	for _, user := range users {
+		access.Users[user.UserID] = &User{User: user.UserID, Instances: []InstanceID{}, Pools: []string{}}
+	}
+
+	groups := []PVEGroup{}
+	err = pve.client.Get(ctx, "/access/groups", &groups)
+	if err != nil {
+		return access, err
+	}
+	members := map[string][]string{}
+	for _, group := range groups {
+		if group.Users != "" {
+			members[group.GroupID] = strings.Split(group.Users, ",")
+		}
+	}
+
+	acl := []PVEACL{}
+	err = pve.client.Get(ctx, "/access/acl", &acl)
+	if err != nil {
+		return access, err
+	}
+	for _, entry := range acl {
+		if entry.RoleID == "NoAccess" {
+			continue
+		}
+		grantees := []string{}
+		switch entry.Type {
+		case "user":
+			grantees = []string{entry.UGID}
+		case "group":
+			grantees = members[entry.UGID]
+		}
+		for _, userid := range grantees {
+			user, ok := access.Users[userid]
+			if !ok {
+				continue
+			}
+			if vmid, ok := strings.CutPrefix(entry.Path, "/vms/"); ok {
+				if id, err := strconv.ParseUint(vmid, 10, 64); err == nil && !slices.Contains(user.Instances, InstanceID(id)) {
+					user.Instances = append(user.Instances, InstanceID(id))
+				}
+			} else if pool, ok := strings.CutPrefix(entry.Path, "/pool/"); ok && !slices.Contains(user.Pools, pool) {
+				user.Pools = append(user.Pools, pool)
+			}
+		}
+	}
+	for _, user := range access.Users {
+		slices.Sort(user.Instances)
+		slices.Sort(user.Pools)
+	}
+
+	return access, nil
+}
+
+// Gets the recent and running tasks of every node in the cluster
+func (pve ProxmoxClient) Tasks(ctx context.Context) (proxmox.Tasks, error) {
+	tasks := proxmox.Tasks{}
+	err := pve.client.Get(ctx, "/cluster/tasks", &tasks)
+	if err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
 // Gets a Node's resources but does not recursively expand instances
-func (pve ProxmoxClient) Node(nodeName string) (*Node, error) {
+func (pve ProxmoxClient) Node(ctx context.Context, nodeName string) (*Node, error) {
 	host := Node{}
 	host.Devices = make(map[DeviceBus]*Device)
+	host.USBDevices = make(map[string]*USBDevice)
 	host.Instances = make(map[InstanceID]*Instance)
 
-	node, err := pve.client.Node(context.Background(), nodeName)
+	node, err := pve.client.Node(ctx, nodeName)
 	if err != nil {
 		return &host, err
 	}
 
 	devices := []PVEDevice{}
-	err = pve.client.Get(context.Background(), fmt.Sprintf("/nodes/%s/hardware/pci", nodeName), &devices)
+	err = pve.client.Get(ctx, fmt.Sprintf("/nodes/%s/hardware/pci", nodeName), &devices)
 	if err != nil {
 		return &host, err
 	}
 
+	mdevFunctions := map[DeviceBus]string{} // first mdev capable function of each device
 	for _, device := range devices {
 		x := strings.Split(device.ID, ".")
 		if len(x) != 2 { // this should always be true, but skip if not
@@ -96,22 +318,76 @@ func (pve ProxmoxClient) Node(nodeName string) (*Node, error) {
 		functionid := FunctionID(x[1])
 		if _, ok := host.Devices[deviceid]; !ok {
 			host.Devices[deviceid] = &Device{
-				Device_Bus:  deviceid,
-				Device_Name: device.Device_Name,
-				Vendor_Name: device.Vendor_Name,
-				Functions:   make(map[FunctionID]*Function),
+				Device_Bus:    deviceid,
+				Device_Name:   device.Device_Name,
+				Vendor_Name:   device.Vendor_Name,
+				Class:         NormalizeHexID(device.Class),
+				PCI_Vendor_ID: NormalizeHexID(device.Vendor),
+				PCI_Device_ID: NormalizeHexID(device.Device),
+				IOMMU_Group:   device.IOMMUGroup,
+				Functions:     make(map[FunctionID]*Function),
 			}
 		}
+		// any function supporting mdev makes the device an mdev device
+		host.Devices[deviceid].Mdev = host.Devices[deviceid].Mdev || bool(device.Mdev)
+		if _, ok := mdevFunctions[deviceid]; !ok && bool(device.Mdev) {
+			mdevFunctions[deviceid] = device.ID
+		}
 		host.Devices[deviceid].Functions[functionid] = &Function{
 			Function_ID:   functionid,
 			Function_Name: device.Subsystem_Device_Name,
 			Vendor_Name:   device.Subsystem_Vendor_Name,
+			IOMMU_Group:   device.IOMMUGroup,
 			Reserved:      false,
 		}
 	}
 
+	for deviceid, functionid := range mdevFunctions {
+		mdevtypes := []PVEMdevType{}
+		err = pve.client.Get(ctx, fmt.Sprintf("/nodes/%s/hardware/pci/%s/mdev", nodeName, functionid), &mdevtypes)
+		if err != nil { // the rest of the node is still usable, the device is left without mdev types
+			log.Printf("Failed to retrieve mdev types of %s on %s: %s", functionid, nodeName, err.Error())
+			continue
+		}
+		host.Devices[deviceid].Mdev_Types = make(map[string]*MdevType, len(mdevtypes))
+		for _, mdevtype := range mdevtypes {
+			host.Devices[deviceid].Mdev_Types[mdevtype.Type] = &MdevType{
+				Type:        mdevtype.Type,
+				Name:        mdevtype.Name,
+				Description: mdevtype.Description,
+				Available:   mdevtype.Available,
+				Remaining:   mdevtype.Available,
+			}
+		}
+	}
+
+	usbdevices := []PVEUSBDevice{}
+	err = pve.client.Get(ctx, fmt.Sprintf("/nodes/%s/hardware/usb", nodeName), &usbdevices)
+	if err != nil {
+		return &host, err
+	}
+
+	for _, usbdevice := range usbdevices {
+		if usbdevice.Class == 9 { // hubs can not be passed through
+			continue
+		}
+		usbpath := usbdevice.USBPath
+		if usbpath == "" {
+			usbpath = fmt.Sprintf("%d-%d", usbdevice.BusNum, usbdevice.Port)
+		}
+		host.USBDevices[usbpath] = &USBDevice{
+			USB_Path:    usbpath,
+			Vendor_ID:   NormalizeHexID(usbdevice.VendID),
+			Product_ID:  NormalizeHexID(usbdevice.ProdID),
+			Vendor_Name: usbdevice.Manufacturer,
+			Device_Name: usbdevice.Product,
+			Serial:      usbdevice.Serial,
+			Reserved:    false,
+		}
+	}
+
 	proctypes := []PVEProctype{}
-	err = pve.client.Get(context.Background(), fmt.Sprintf("/nodes/%s/capabilities/qemu/cpu", nodeName), &proctypes)
+	err = pve.client.Get(ctx, fmt.Sprintf("/nodes/%s/capabilities/qemu/cpu", nodeName), &proctypes)
 	if err != nil {
 		return &host, err
 	}
@@ -119,6 +395,7 @@ func (pve ProxmoxClient) Node(nodeName string) (*Node, error) {
 		host.Proctypes = append(host.Proctypes, proctype.Name)
 	}
 
+	host.Storages = make(map[string]*Storage)
 	host.Name = node.Name
 	host.Cores = uint64(node.CPUInfo.CPUs)
 	host.Memory = uint64(node.Memory.Total)
@@ -128,9 +405,14 @@ func (pve ProxmoxClient) Node(nodeName string) (*Node, error) {
 	return &host, err
 }
 
+// Gets only the PVE handle of a node, used to fetch instances of a node which was not built from PVE
+func (pve ProxmoxClient) PVENode(ctx context.Context, nodeName string) (*proxmox.Node, error) {
+	return pve.client.Node(ctx, nodeName)
+}
+
 // Get all VM IDs on specified host
-func (host *Node) VirtualMachines() ([]uint, error) {
-	vms, err := host.pvenode.VirtualMachines(context.Background())
+func (host *Node) VirtualMachines(ctx context.Context) ([]uint, error) {
+	vms, err := host.pvenode.VirtualMachines(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -142,21 +424,23 @@ func (host *Node) VirtualMachines() ([]uint, error) {
 }
 
 // Get a VM's CPU, Memory but does not recursively link Devices, Disks, Drives, Nets
-func (host *Node) VirtualMachine(VMID uint) (*Instance, error) {
+func (host *Node) VirtualMachine(ctx context.Context, VMID uint) (*Instance, error) {
 	instance := Instance{}
-	vm, err := host.pvenode.VirtualMachine(context.Background(), int(VMID))
+	vm, err := host.pvenode.VirtualMachine(ctx, int(VMID))
 	if err != nil {
 		return &instance, err
 	}
 
 	config := vm.VirtualMachineConfig
 	instance.configHostPCIs = config.MergeHostPCIs()
+	instance.configUSBs = MergeVMUSBs(config)
 	instance.configNets = config.MergeNets()
 	instance.configDisks = MergeVMDisksAndUnused(config)
 	instance.configBoot = config.Boot
 
 	instance.pveconfig = config
 	instance.Type = VM
+	instance.Digest = config.Digest
 
 	instance.Name = vm.Name
 	instance.Proctype = vm.VirtualMachineConfig.CPU
@@ -165,10 +449,22 @@ func (host *Node) VirtualMachine(VMID uint) (*Instance, error) {
 	instance.Volumes = make(map[VolumeID]*Volume)
 	instance.Nets = make(map[NetID]*Net)
 	instance.Devices = make(map[DeviceID]*Device)
+	instance.USBDevices = make(map[DeviceID]*USBDevice)
 
 	return &instance, nil
 }
 
+// go-proxmox's MergeUSBs stores the merged usb entries over the hostpci entries, so they are collected here instead
+func MergeVMUSBs(vmc *proxmox.VirtualMachineConfig) map[string]string {
+	usbs := map[string]string{}
+	for i, usb := range []string{vmc.USB0, vmc.USB1, vmc.USB2, vmc.USB3, vmc.USB4, vmc.USB5, vmc.USB6, vmc.USB7, vmc.USB8, vmc.USB9, vmc.USB10, vmc.USB11, vmc.USB12, vmc.USB13, vmc.USB14} {
+		if usb != "" {
+			usbs[fmt.Sprintf("usb%d", i)] = usb
+		}
+	}
+	return usbs
+}
+
 func MergeVMDisksAndUnused(vmc *proxmox.VirtualMachineConfig) map[string]string {
 	mergedDisks := vmc.MergeDisks()
 	for k, v := range vmc.MergeUnuseds() {
@@ -178,8 +474,8 @@ func MergeVMDisksAndUnused(vmc *proxmox.VirtualMachineConfig) map[string]string
 }
 
 // Get all CT IDs on specified host
-func (host *Node) Containers() ([]uint, error) {
-	cts, err := host.pvenode.Containers(context.Background())
+func (host *Node) Containers(ctx context.Context) ([]uint, error) {
+	cts, err := host.pvenode.Containers(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -191,20 +487,22 @@ func (host *Node) Containers() ([]uint, error) {
 }
 
 // Get a CT's CPU, Memory, Swap but does not recursively link Devices, Disks, Drives, Nets
-func (host *Node) Container(VMID uint) (*Instance, error) {
+func (host *Node) Container(ctx context.Context, VMID uint) (*Instance, error) {
 	instance := Instance{}
-	ct, err := host.pvenode.Container(context.Background(), int(VMID))
+	ct, err := host.pvenode.Container(ctx, int(VMID))
 	if err != nil {
 		return &instance, err
 	}
 
 	config := ct.ContainerConfig
 	instance.configHostPCIs = make(map[string]string)
+	instance.configUSBs = make(map[string]string)
 	instance.configNets = config.MergeNets()
 	instance.configDisks = MergeCTDisksAndUnused(config)
 
 	instance.pveconfig = config
 	instance.Type = CT
+	instance.Digest = config.Digest
 
 	instance.Name = ct.Name
 	instance.Cores = uint64(ct.ContainerConfig.Cores)
@@ -212,6 +510,7 @@ func (host *Node) Container(VMID uint) (*Instance, error) {
 	instance.Swap = uint64(ct.ContainerConfig.Swap) * MiB
 	instance.Volumes = make(map[VolumeID]*Volume)
 	instance.Nets = make(map[NetID]*Net)
+	instance.USBDevices = make(map[DeviceID]*USBDevice)
 
 	return &instance, nil
 }
@@ -229,19 +528,19 @@ func MergeCTDisksAndUnused(cc *proxmox.ContainerConfig) map[string]string {
 }
 
 // get volume format, size, volumeid, and storageid from instance volume data string (eg: local:100/vm-100-disk-0.raw ... )
-func GetVolumeInfo(host *Node, volume string) (*Volume, error) {
+func GetVolumeInfo(ctx context.Context, host *Node, volume string) (*Volume, error) {
 	volumeData := Volume{}
 
 	volumeObj := PVEObjectStringToMap(volume)
 	volumeFile := volumeObj[""]
 	volumeStorage := strings.Split(volumeFile, ":")[0]
 
-	storage, err := host.pvenode.Storage(context.Background(), volumeStorage)
+	storage, err := host.pvenode.Storage(ctx, volumeStorage)
 	if err != nil {
 		return &volumeData, nil
 	}
 
-	content, err := storage.GetContent(context.Background())
+	content, err := storage.GetContent(ctx)
 	if err != nil {
 		return &volumeData, nil
 	}
@@ -302,3 +601,57 @@ func PVEObjectStringToMap(objectstring string) map[string]string {
 	}
 	return objectmap
 }
+
+// get the device paths of each node from a mapping's entries (eg: node=pve1,path=0000:01:00.0;0000:02:00.0,id=10de:2230)
+//
+// usb entries have either a port path or a vendor:device id
+func GetMappingInfo(pvemapping PVEMapping) *Mapping {
+	mapping := Mapping{
+		ID:          pvemapping.ID,
+		Description: pvemapping.Description,
+		Nodes:       make(map[string][]string),
+	}
+	for _, entry := range pvemapping.Map {
+		entryObj := PVEObjectStringToMap(entry)
+		hostName := entryObj["node"]
+		if hostName == "" {
+			continue
+		}
+		if path, ok := entryObj["path"]; ok {
+			mapping.Nodes[hostName] = append(mapping.Nodes[hostName], strings.Split(path, ";")...)
+		} else if id, ok := entryObj["id"]; ok {
+			mapping.Nodes[hostName] = append(mapping.Nodes[hostName], id)
+		}
+	}
+	return &mapping
+}
+
+// maps a /cluster/resources guest type (qemu, lxc) to an instance type
+func ResourceInstanceType(resource *proxmox.ClusterResource) InstanceType {
+	if resource.Type == "lxc" {
+		return CT
+	}
+	return VM
+}
+
+// the parts of a /cluster/resources guest entry that indicate the guest may need to be refetched
+func ResourceState(resource *proxmox.ClusterResource) string {
+	return fmt.Sprintf("%s:%s:%s:%s:%d:%d:%d:%d:%s:%s", resource.Type, resource.Node, resource.Status, resource.Name, resource.Template, resource.MaxCPU, resource.MaxMem, resource.MaxDisk, resource.Pool, resource.Tags)
+}
+
+// get a node storage's type, content and usage from its /cluster/resources entry
+func GetStorageInfo(resource *proxmox.ClusterResource) *Storage {
+	content := []string{}
+	if resource.Content != "" {
+		content = strings.Split(resource.Content, ",")
+	}
+	return &Storage{
+		Storage: resource.Storage,
+		Type:    resource.PluginType,
+		Content: content,
+		Shared:  resource.Shared == 1,
+		Active:  resource.Status == "available",
+		Size:    resource.MaxDisk,
+		Used:    resource.Disk,
+	}
+}
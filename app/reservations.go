@@ -0,0 +1,382 @@
+package app
+
+import (
+	"crypto/rand"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// how long finished reservations can be polled before they are discarded
+const ReservationRetention = 10 * time.Minute
+
+// lowest and highest vmids PVE accepts
+const MinVMID InstanceID = 100
+const MaxVMID InstanceID = 999999999
+
+type VMIDRange struct {
+	Min InstanceID `json:"min"`
+	Max InstanceID `json:"max"`
+}
+
+type VMIDConfig struct {
+	Default VMIDRange            `json:"default"` // applied to users without their own range and requests without a user
+	Users   map[string]VMIDRange `json:"users"`
+}
+
+// get the range of vmids a user may allocate
+func (config VMIDConfig) Range(user string) VMIDRange {
+	if vmids, ok := config.Users[user]; ok && user != "" {
+		return vmids
+	}
+	return config.Default
+}
+
+type ReservationState string
+
+const (
+	ReservationPending   ReservationState = "pending"
+	ReservationCommitted ReservationState = "committed"
+	ReservationReleased  ReservationState = "released"
+	ReservationExpired   ReservationState = "expired"
+)
+
+type ReservedDevice struct {
+	Device_Bus  DeviceBus `json:"device_bus"`
+	Device_Name string    `json:"device_name"`
+}
+
+// resources held for a user until they are allocated in PVE, pending reservations count as used in every capacity calculation
+type Reservation struct {
+	ID       string            `json:"id"`
+	State    ReservationState  `json:"state"`
+	User     string            `json:"user"`
+	Pool     string            `json:"pool"`
+	Node     string            `json:"node"`
+	VMID     InstanceID        `json:"vmid,omitempty"`
+	Cores    uint64            `json:"cores"`
+	Memory   uint64            `json:"memory"`
+	Swap     uint64            `json:"swap"`
+	Disk     map[string]uint64 `json:"disk"` // bytes per storage
+	Devices  []ReservedDevice  `json:"devices"`
+	Created  time.Time         `json:"created"`
+	Expires  time.Time         `json:"expires"`
+	Finished time.Time         `json:"finished,omitzero"`
+}
+
+// resources to reserve, devices are given either by bus or by name in which case a free device with that name is chosen
+type ReservationRequest struct {
+	User    string            `json:"user"`
+	Pool    string            `json:"pool"`
+	Node    string            `json:"node"`
+	VMID    InstanceID        `json:"vmid"`
+	Cores   uint64            `json:"cores"`
+	Memory  uint64            `json:"memory"`
+	Swap    uint64            `json:"swap"`
+	Disk    map[string]uint64 `json:"disk"`
+	Devices []ReservedDevice  `json:"devices"`
+	TTL     int               `json:"ttl"` // seconds, defaults to the configured reservation ttl
+}
+
+type ReservationManager struct {
+	lock         sync.Mutex // serializes reservations so that concurrent requests cannot hold the same resources
+	cluster      *Cluster
+	policy       AdmissionPolicy
+	defaultTTL   time.Duration
+	maxTTL       time.Duration
+	reservations map[string]*Reservation
+}
+
+func NewReservationManager(cluster *Cluster, policy AdmissionPolicy, defaultTTL time.Duration, maxTTL time.Duration) *ReservationManager {
+	return &ReservationManager{
+		cluster:      cluster,
+		policy:       policy,
+		defaultTTL:   defaultTTL,
+		maxTTL:       maxTTL,
+		reservations: make(map[string]*Reservation),
+	}
+}
+
+// holds the requested resources if they are free and within quota
+//
+// returns a copy of the reservation if it was created, and the result of checking the request, which is denied if any resource is unavailable
+func (manager *ReservationManager) Reserve(request ReservationRequest) (Reservation, *AdmissionResult, error) {
+	ttl := manager.TTL(request.TTL)
+	if len(request.Devices) > 0 && request.Node == "" {
+		return Reservation{}, nil, fmt.Errorf("devices can only be reserved on a node")
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	manager.prune()
+	return manager.reserve(request, ttl)
+}
+
+// must be called with the manager lock held
+func (manager *ReservationManager) reserve(request ReservationRequest, ttl time.Duration) (Reservation, *AdmissionResult, error) {
+	snapshot := manager.cluster.Snapshot()
+	pending := manager.pending()
+
+	checks := []AdmissionCheck{}
+	if request.VMID != 0 {
+		checks = append(checks, CheckVMID(snapshot, pending, request.VMID))
+	}
+
+	devices := []ReservedDevice{}
+	if len(request.Devices) > 0 {
+		var deviceChecks []AdmissionCheck
+		devices, deviceChecks = ResolveDevices(snapshot, pending, request.Node, request.Devices)
+		checks = append(checks, deviceChecks...)
+	}
+
+	demand := NewDemand()
+	if request.VMID != 0 {
+		demand.Instances = 1
+	}
+	demand.Cores = int64(request.Cores)
+	demand.Memory = int64(request.Memory)
+	demand.Swap = int64(request.Swap)
+	for storage, size := range request.Disk {
+		demand.Disk[storage] = int64(size)
+	}
+	for _, device := range devices {
+		demand.Devices[device.Device_Name]++
+	}
+	// devices were already matched against free devices by bus, so the node is only checked for countable resources
+	nodeDemand := demand
+	nodeDemand.Devices = map[string]int64{}
+
+	admission, err := snapshot.AdmitDemand(request.User, request.Pool, request.Node, demand, nodeDemand, manager.policy, pending)
+	if err != nil {
+		return Reservation{}, nil, err
+	}
+	result := NewAdmissionResult(append(checks, admission...))
+	if !result.Allowed {
+		return Reservation{}, result, nil
+	}
+
+	reservation := &Reservation{
+		ID:      rand.Text(),
+		State:   ReservationPending,
+		User:    request.User,
+		Pool:    request.Pool,
+		Node:    request.Node,
+		VMID:    request.VMID,
+		Cores:   request.Cores,
+		Memory:  request.Memory,
+		Swap:    request.Swap,
+		Disk:    maps.Clone(request.Disk),
+		Devices: devices,
+		Created: time.Now(),
+	}
+	if reservation.Disk == nil {
+		reservation.Disk = make(map[string]uint64)
+	}
+	reservation.Expires = reservation.Created.Add(ttl)
+	manager.reservations[reservation.ID] = reservation
+
+	return *reservation, result, nil
+}
+
+// get the ttl of a reservation requested for the given seconds, 0 uses the default ttl
+func (manager *ReservationManager) TTL(seconds int) time.Duration {
+	if seconds <= 0 {
+		return manager.defaultTTL
+	}
+	return min(time.Duration(seconds)*time.Second, manager.maxTTL)
+}
+
+// finds the lowest vmid in a range which is neither in the cluster nor held by a pending reservation
+//
+// if reserve is true, the vmid is reserved for the user before any other request can find it, and the reservation is returned
+func (manager *ReservationManager) NextVMID(vmids VMIDRange, user string, reserve bool, ttl int) (InstanceID, *Reservation, *AdmissionResult, error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	manager.prune()
+	snapshot := manager.cluster.Snapshot()
+	held := map[InstanceID]bool{}
+	for _, reservation := range manager.pending() {
+		held[reservation.VMID] = true
+	}
+
+	for vmid := vmids.Min; vmid <= vmids.Max; vmid++ {
+		if _, ok := snapshot.Index[vmid]; ok || held[vmid] {
+			continue
+		}
+		if !reserve {
+			return vmid, nil, nil, nil
+		}
+		reservation, result, err := manager.reserve(ReservationRequest{User: user, VMID: vmid}, manager.TTL(ttl))
+		if err != nil || !result.Allowed {
+			return vmid, nil, result, err
+		}
+		return vmid, &reservation, result, nil
+	}
+
+	return 0, nil, nil, fmt.Errorf("no free vmid in %d-%d", vmids.Min, vmids.Max)
+}
+
+// checks that a vmid is neither in the cluster nor held by a pending reservation
+func CheckVMID(snapshot *Snapshot, pending []*Reservation, vmid InstanceID) AdmissionCheck {
+	check := AdmissionCheck{Resource: "vmid", Scope: "cluster", Requested: int64(vmid), Allowed: true}
+	if hostName, ok := snapshot.Locate(uint(vmid)); ok {
+		check.Allowed = false
+		check.Reason = fmt.Sprintf("vmid %d is in use on %s", vmid, hostName)
+	}
+	for _, reservation := range pending {
+		if reservation.VMID == vmid {
+			check.Allowed = false
+			check.Reason = fmt.Sprintf("vmid %d is reserved", vmid)
+		}
+	}
+	return check
+}
+
+// picks the node device for each requested device, a device is free if it is not reserved in PVE or by a pending reservation, including through its iommu group
+func ResolveDevices(snapshot *Snapshot, pending []*Reservation, hostName string, requested []ReservedDevice) ([]ReservedDevice, []AdmissionCheck) {
+	devices := []ReservedDevice{}
+	checks := []AdmissionCheck{}
+	scope := "node " + hostName
+
+	host, err := snapshot.GetNode(hostName)
+	if err != nil {
+		return devices, []AdmissionCheck{{Resource: "node", Scope: scope, Allowed: false, Reason: err.Error()}}
+	}
+
+	held := PendingDevices(hostName, pending)
+	free := func(device *Device) bool {
+		return host.DeviceFree(device, held)
+	}
+
+	for _, request := range requested {
+		var chosen *Device
+		if request.Device_Bus != "" {
+			resource := "device:" + string(request.Device_Bus)
+			device, ok := host.Devices[request.Device_Bus]
+			if !ok {
+				checks = append(checks, AdmissionCheck{Resource: resource, Scope: scope, Requested: 1, Allowed: false, Reason: fmt.Sprintf("%s not found in host %s devices", request.Device_Bus, hostName)})
+				continue
+			}
+			if !free(device) {
+				checks = append(checks, AdmissionCheck{Resource: resource, Scope: scope, Requested: 1, Used: 1, Limit: 1, Allowed: false, Reason: fmt.Sprintf("%s is reserved", request.Device_Bus)})
+				continue
+			}
+			chosen = device
+		} else {
+			resource := "device:" + request.Device_Name
+			for _, bus := range slices.Sorted(maps.Keys(host.Devices)) {
+				if device := host.Devices[bus]; device.Device_Name == request.Device_Name && free(device) {
+					chosen = device
+					break
+				}
+			}
+			if chosen == nil {
+				checks = append(checks, AdmissionCheck{Resource: resource, Scope: scope, Requested: 1, Allowed: false, Reason: fmt.Sprintf("%s has no free %s", scope, request.Device_Name)})
+				continue
+			}
+		}
+		held[chosen.Device_Bus] = true
+		devices = append(devices, ReservedDevice{Device_Bus: chosen.Device_Bus, Device_Name: chosen.Device_Name})
+		checks = append(checks, AdmissionCheck{Resource: "device:" + string(chosen.Device_Bus), Scope: scope, Requested: 1, Limit: 1, Allowed: true})
+	}
+
+	return devices, checks
+}
+
+// get a copy of a reservation by its id
+func (manager *ReservationManager) Get(id string) (Reservation, error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	manager.prune()
+	reservation, ok := manager.reservations[id]
+	if !ok {
+		return Reservation{}, fmt.Errorf("reservation %s not found", id)
+	}
+	return *reservation, nil
+}
+
+// marks a pending reservation as allocated in PVE, its resources are no longer held because they are now counted by the model
+func (manager *ReservationManager) Commit(id string) (Reservation, error) {
+	return manager.finish(id, ReservationCommitted)
+}
+
+// releases a pending reservation without allocating it
+func (manager *ReservationManager) Release(id string) (Reservation, error) {
+	return manager.finish(id, ReservationReleased)
+}
+
+func (manager *ReservationManager) finish(id string, state ReservationState) (Reservation, error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	manager.prune()
+	reservation, ok := manager.reservations[id]
+	if !ok {
+		return Reservation{}, fmt.Errorf("reservation %s not found", id)
+	}
+	if reservation.State != ReservationPending {
+		return *reservation, fmt.Errorf("reservation %s is %s", id, reservation.State)
+	}
+	reservation.State = state
+	reservation.Finished = time.Now()
+	return *reservation, nil
+}
+
+// get copies of every pending reservation
+func (manager *ReservationManager) Pending() []*Reservation {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	manager.prune()
+	return manager.pending()
+}
+
+// must be called with the manager lock held
+func (manager *ReservationManager) pending() []*Reservation {
+	pending := []*Reservation{}
+	for _, id := range slices.Sorted(maps.Keys(manager.reservations)) {
+		if reservation := manager.reservations[id]; reservation.State == ReservationPending {
+			held := *reservation
+			pending = append(pending, &held)
+		}
+	}
+	return pending
+}
+
+// commits pending vmid reservations once their instance appears in the model, used as a cluster listener
+func (manager *ReservationManager) Publish(snapshot *Snapshot, changes []Change) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	added := map[InstanceID]bool{}
+	for _, change := range changes {
+		if change.Type == InstanceAdded {
+			added[change.VMID] = true
+		}
+	}
+	for _, reservation := range manager.reservations {
+		if reservation.State == ReservationPending && reservation.VMID != 0 && added[reservation.VMID] {
+			reservation.State = ReservationCommitted
+			reservation.Finished = time.Now()
+		}
+	}
+}
+
+// expires pending reservations past their ttl and discards finished reservations older than the retention period, must be called with the manager lock held
+func (manager *ReservationManager) prune() {
+	now := time.Now()
+	for id, reservation := range manager.reservations {
+		if reservation.State == ReservationPending && now.After(reservation.Expires) {
+			reservation.State = ReservationExpired
+			reservation.Finished = reservation.Expires
+		}
+		if !reservation.Finished.IsZero() && now.Sub(reservation.Finished) > ReservationRetention {
+			delete(manager.reservations, id)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package app
+
+import (
+	"context"
+	"sync"
+)
+
+// limits the number of concurrent requests made to PVE, both across the cluster and to each node
+type Scheduler struct {
+	global  chan struct{}
+	perNode int
+	lock    sync.Mutex
+	nodes   map[string]chan struct{}
+}
+
+func NewScheduler(global int, perNode int) *Scheduler {
+	return &Scheduler{
+		global:  make(chan struct{}, max(global, 1)),
+		perNode: max(perNode, 1),
+		nodes:   make(map[string]chan struct{}),
+	}
+}
+
+// get the slots for a node, creating them if this is the first request to the node
+func (scheduler *Scheduler) node(hostName string) chan struct{} {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	slots, ok := scheduler.nodes[hostName]
+	if !ok {
+		slots = make(chan struct{}, scheduler.perNode)
+		scheduler.nodes[hostName] = slots
+	}
+	return slots
+}
+
+// blocks until both a node slot and a global slot are available, or returns an error if ctx is cancelled first
+//
+// the node slot is acquired first so that a busy node does not hold global slots that other nodes could use
+func (scheduler *Scheduler) Acquire(ctx context.Context, hostName string) error {
+	slots := scheduler.node(hostName)
+
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case scheduler.global <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		<-slots
+		return ctx.Err()
+	}
+}
+
+// releases the slots acquired by a previous Acquire for the node
+func (scheduler *Scheduler) Release(hostName string) {
+	<-scheduler.global
+	<-scheduler.node(hostName)
+}
+
+// runs fn while holding a slot for the node, fn is not run if ctx is cancelled before a slot is available
+func (scheduler *Scheduler) Do(ctx context.Context, hostName string, fn func() error) error {
+	err := scheduler.Acquire(ctx, hostName)
+	if err != nil {
+		return err
+	}
+	defer scheduler.Release(hostName)
+
+	return fn()
+}
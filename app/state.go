@@ -0,0 +1,190 @@
+package app
+
+import (
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// version of the state file layout, state files with a different version are ignored
+const StateVersion = 3
+
+// contents of the state file
+type State struct {
+	Version  int
+	Saved    time.Time
+	Snapshot *Snapshot
+}
+
+func init() {
+	// boot orders hold volumes and nets as any
+	gob.Register(&Volume{})
+	gob.Register(&Net{})
+}
+
+// writes a snapshot to path, the file is replaced atomically so that a crash never leaves a partial state file
+func SaveState(path string, snapshot *Snapshot) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) // no-op once renamed
+
+	err = gob.NewEncoder(file).Encode(State{Version: StateVersion, Saved: time.Now(), Snapshot: snapshot})
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// reads a snapshot written by SaveState, the snapshot is marked as stale
+func LoadState(path string) (*Snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	state := State{}
+	if err := gob.NewDecoder(file).Decode(&state); err != nil {
+		return nil, err
+	}
+	if state.Version != StateVersion {
+		return nil, fmt.Errorf("state file version %d does not match %d", state.Version, StateVersion)
+	}
+	if state.Snapshot == nil {
+		return nil, fmt.Errorf("state file has no snapshot")
+	}
+
+	snapshot := state.Snapshot
+	snapshot.Stale = true
+	if snapshot.Nodes == nil {
+		snapshot.Nodes = make(map[string]*Node)
+	}
+	for _, host := range snapshot.Nodes {
+		host.restore()
+	}
+	snapshot.Index = BuildIndex(snapshot.Nodes)
+	if snapshot.Access == nil {
+		snapshot.Access = NewAccess()
+	}
+	snapshot.Access.restore()
+	if snapshot.Mappings == nil {
+		snapshot.Mappings = NewMappings()
+	}
+	snapshot.Mappings.restore()
+	return snapshot, nil
+}
+
+// gob does not encode empty maps and slices, replace them so that a loaded node compares equal to a freshly built one
+//
+// the node's PVE handle and each instance's /cluster/resources state are not saved, so the first sync after loading refetches every guest
+func (host *Node) restore() {
+	if host.Devices == nil {
+		host.Devices = make(map[DeviceBus]*Device)
+	}
+	if host.Instances == nil {
+		host.Instances = make(map[InstanceID]*Instance)
+	}
+	if host.Storages == nil {
+		host.Storages = make(map[string]*Storage)
+	}
+	if host.USBDevices == nil {
+		host.USBDevices = make(map[string]*USBDevice)
+	}
+	for _, device := range host.Devices {
+		device.restore()
+	}
+	for _, storage := range host.Storages {
+		if storage.Content == nil {
+			storage.Content = []string{}
+		}
+	}
+	for _, instance := range host.Instances {
+		if instance.Tags == nil {
+			instance.Tags = []string{}
+		}
+		if instance.Volumes == nil {
+			instance.Volumes = make(map[VolumeID]*Volume)
+		}
+		if instance.Nets == nil {
+			instance.Nets = make(map[NetID]*Net)
+		}
+		if instance.Devices == nil && instance.Type == VM { // containers have no pci devices
+			instance.Devices = make(map[DeviceID]*Device)
+		}
+		if instance.USBDevices == nil {
+			instance.USBDevices = make(map[DeviceID]*USBDevice)
+		}
+		for _, device := range instance.Devices {
+			device.restore()
+		}
+	}
+}
+
+func (device *Device) restore() {
+	if device.Functions == nil {
+		device.Functions = make(map[FunctionID]*Function)
+	}
+}
+
+func (access *Access) restore() {
+	if access.Pools == nil {
+		access.Pools = make(map[string]*Pool)
+	}
+	if access.Users == nil {
+		access.Users = make(map[string]*User)
+	}
+	for _, user := range access.Users {
+		if user.Instances == nil {
+			user.Instances = []InstanceID{}
+		}
+		if user.Pools == nil {
+			user.Pools = []string{}
+		}
+	}
+}
+
+func (mappings *Mappings) restore() {
+	if mappings.PCI == nil {
+		mappings.PCI = make(map[string]*Mapping)
+	}
+	if mappings.USB == nil {
+		mappings.USB = make(map[string]*Mapping)
+	}
+	for _, group := range []map[string]*Mapping{mappings.PCI, mappings.USB} {
+		for _, mapping := range group {
+			if mapping.Nodes == nil {
+				mapping.Nodes = make(map[string][]string)
+			}
+		}
+	}
+}
+
+// saves the published snapshot to path every interval if it changed since it was last saved
+func (cluster *Cluster) PersistState(path string, interval time.Duration) {
+	saved := uint64(0)
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		snapshot := cluster.Snapshot()
+		if snapshot.Stale || snapshot.Generation == saved {
+			continue
+		}
+		if err := SaveState(path, snapshot); err != nil {
+			log.Printf("Failed to save state to %s: %s", path, err.Error())
+			continue
+		}
+		saved = snapshot.Generation
+	}
+}
@@ -2,26 +2,78 @@ package app
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/luthermonson/go-proxmox"
 )
 
 type Cluster struct {
-	lock  sync.Mutex
-	pve   ProxmoxClient
-	Nodes map[string]*Node
+	lock      sync.Mutex // serializes writers, readers use the published snapshot
+	pve       ProxmoxClient
+	scheduler *Scheduler
+	snapshot  atomic.Pointer[Snapshot]
+	listeners []func(*Snapshot, []Change)
+	changed   map[InstanceID]uint64 // generation each vmid was last changed in, guarded by lock
 }
 
+// an immutable generation of the cluster model, never modified after being published
+type Snapshot struct {
+	Generation uint64                `json:"generation"`
+	Built      time.Time             `json:"built"`
+	Nodes      map[string]*Node      `json:"nodes"`
+	Index      map[InstanceID]string `json:"index"` // owning node of each vmid
+	Access     *Access               `json:"access"`
+	Mappings   *Mappings             `json:"mappings"`
+	Stale      bool                  `json:"stale"` // loaded from the state file and not yet refreshed by a sync
+}
+
+// pools and instance ownership from the PVE ACL
+type Access struct {
+	Pools map[string]*Pool `json:"pools"`
+	Users map[string]*User `json:"users"`
+}
+
+type Pool struct {
+	Pool    string `json:"pool"`
+	Comment string `json:"comment"`
+}
+
+// instances and pools granted to a user through ACL entries on /vms/<vmid> and /pool/<pool>, either directly or through a group
+type User struct {
+	User      string       `json:"user"`
+	Instances []InstanceID `json:"instances"`
+	Pools     []string     `json:"pools"`
+}
+
+const (
+	NodeOnline  = "online"
+	NodeOffline = "offline"
+)
+
 type Node struct {
-	lock      sync.Mutex
-	Name      string                   `json:"name"`
-	Cores     uint64                   `json:"cores"`
-	Memory    uint64                   `json:"memory"`
-	Swap      uint64                   `json:"swap"`
-	Devices   map[DeviceBus]*Device    `json:"devices"`
-	Instances map[InstanceID]*Instance `json:"instances"`
-	Proctypes []string                 `json:"cpus"`
-	pvenode   *proxmox.Node
+	Name       string                   `json:"name"`
+	Status     string                   `json:"status"`
+	Cores      uint64                   `json:"cores"`
+	Memory     uint64                   `json:"memory"`
+	Swap       uint64                   `json:"swap"`
+	Devices    map[DeviceBus]*Device    `json:"devices"`
+	Instances  map[InstanceID]*Instance `json:"instances"`
+	Storages   map[string]*Storage      `json:"storages"`
+	USBDevices map[string]*USBDevice    `json:"usb_devices"` // keyed by port path
+	Proctypes  []string                 `json:"cpus"`
+	pvenode    *proxmox.Node
+	mappings   *Mappings // used to resolve mapped devices of instances
+}
+
+type Storage struct {
+	Storage string   `json:"storage"`
+	Type    string   `json:"type"`
+	Content []string `json:"content"`
+	Shared  bool     `json:"shared"`
+	Active  bool     `json:"active"`
+	Size    uint64   `json:"size"`
+	Used    uint64   `json:"used"`
 }
 
 type InstanceID uint64
@@ -33,22 +85,28 @@ const (
 )
 
 type Instance struct {
-	lock           sync.Mutex
-	Type           InstanceType         `json:"type"`
-	Name           string               `json:"name"`
-	Proctype       string               `json:"cpu"`
-	Cores          uint64               `json:"cores"`
-	Memory         uint64               `json:"memory"`
-	Swap           uint64               `json:"swap"`
-	Volumes        map[VolumeID]*Volume `json:"volumes"`
-	Nets           map[NetID]*Net       `json:"nets"`
-	Devices        map[DeviceID]*Device `json:"devices"`
-	Boot           BootOrder            `json:"boot"`
+	Type           InstanceType            `json:"type"`
+	Digest         string                  `json:"digest"` // digest of the PVE config the instance was built from
+	Name           string                  `json:"name"`
+	Status         string                  `json:"status"`
+	Pool           string                  `json:"pool"`
+	Tags           []string                `json:"tags"`
+	Proctype       string                  `json:"cpu"`
+	Cores          uint64                  `json:"cores"`
+	Memory         uint64                  `json:"memory"`
+	Swap           uint64                  `json:"swap"`
+	Volumes        map[VolumeID]*Volume    `json:"volumes"`
+	Nets           map[NetID]*Net          `json:"nets"`
+	Devices        map[DeviceID]*Device    `json:"devices"`
+	USBDevices     map[DeviceID]*USBDevice `json:"usb_devices"`
+	Boot           BootOrder               `json:"boot"`
 	pveconfig      any
 	configDisks    map[string]string
 	configNets     map[string]string
 	configHostPCIs map[string]string
+	configUSBs     map[string]string
 	configBoot     string
+	resourceState  string
 }
 
 var VolumeTypes = []string{
@@ -82,24 +140,131 @@ type Net struct {
 type DeviceID string
 type DeviceBus string
 type Device struct {
-	Device_ID   DeviceID                 `json:"device_id"`
-	Device_Bus  DeviceBus                `json:"device_bus"`
-	Device_Name string                   `json:"device_name"`
-	Vendor_Name string                   `json:"vendor_name"`
-	Functions   map[FunctionID]*Function `json:"functions"`
-	Reserved    bool                     `json:"reserved"`
-	Value       string
+	Device_ID      DeviceID                 `json:"device_id"`
+	Device_Bus     DeviceBus                `json:"device_bus"`
+	Device_Name    string                   `json:"device_name"`
+	Vendor_Name    string                   `json:"vendor_name"`
+	Class          string                   `json:"class"`
+	PCI_Vendor_ID  string                   `json:"pci_vendor_id"`
+	PCI_Device_ID  string                   `json:"pci_device_id"`
+	IOMMU_Group    int                      `json:"iommu_group"`          // iommu group of the device's first function, -1 if it is not in an iommu group
+	Mdev           bool                     `json:"mdev"`                 // supports mediated devices
+	Mdev_Types     map[string]*MdevType     `json:"mdev_types,omitempty"` // mediated device types the node can create on the device
+	Mdev_Type      string                   `json:"mdev_type,omitempty"`  // mediated device type an instance was assigned, the device itself is not reserved
+	Functions      map[FunctionID]*Function `json:"functions"`
+	Reserved       bool                     `json:"reserved"`
+	Group_Reserved bool                     `json:"group_reserved"`    // reserved only because its functions share iommu groups with reserved functions
+	Partial        bool                     `json:"partial"`           // only some functions are reserved
+	Mapping        string                   `json:"mapping,omitempty"` // resource mapping the device was assigned through
+	Value          string
 }
 
 type FunctionID string
 type Function struct {
-	Function_ID   FunctionID `json:"function_id"`
-	Function_Name string     `json:"subsystem_device_name"`
-	Vendor_Name   string     `json:"subsystem_vendor_name"`
-	Reserved      bool       `json:"reserved"`
+	Function_ID    FunctionID `json:"function_id"`
+	Function_Name  string     `json:"subsystem_device_name"`
+	Vendor_Name    string     `json:"subsystem_vendor_name"`
+	IOMMU_Group    int        `json:"iommu_group"` // -1 if the function is not in an iommu group, functions of a device can be split into separate groups by acs
+	Reserved       bool       `json:"reserved"`
+	Group_Reserved bool       `json:"group_reserved"` // reserved because another function in its iommu group is reserved
+}
+
+// a mediated device type of an mdev capable device, eg: a vgpu profile
+type MdevType struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Available   int    `json:"available"` // instances PVE reports it can still create
+	Assigned    int    `json:"assigned"`  // instances configured with this type
+	Remaining   int    `json:"remaining"` // available minus assigned instances which are not running and have not created theirs yet
+}
+
+type USBDevice struct {
+	USB_ID      DeviceID `json:"usb_id,omitempty"` // instance config key, eg: usb0
+	USB_Path    string   `json:"usb_path"`         // host port path, eg: 1-2.3
+	Vendor_ID   string   `json:"vendor_id"`
+	Product_ID  string   `json:"product_id"`
+	Vendor_Name string   `json:"vendor_name"`
+	Device_Name string   `json:"device_name"`
+	Serial      string   `json:"serial"`
+	Reserved    bool     `json:"reserved"`
+	Mapping     string   `json:"mapping,omitempty"` // resource mapping the device was assigned through
+	Value       string   `json:"value,omitempty"`
+}
+
+// PVE resource mappings from /cluster/mapping/pci and /cluster/mapping/usb
+type Mappings struct {
+	PCI map[string]*Mapping `json:"pci"`
+	USB map[string]*Mapping `json:"usb"`
+}
+
+type Mapping struct {
+	ID          string              `json:"id"`
+	Description string              `json:"description"`
+	Nodes       map[string][]string `json:"nodes"` // device paths of each node, pci bus ids or usb ports or vendor:device ids
 }
 
 type BootOrder struct {
 	Enabled  []any `json:"enabled"`
 	Disabled []any `json:"disabled"`
 }
+
+type SyncMode string
+
+const (
+	FastSync SyncMode = "fast" // only refetch guests whose /cluster/resources state changed, config digests are never checked so config only changes such as devices, nets or boot order are missed until a full sync
+	FullSync SyncMode = "full" // refetch every guest
+)
+
+type ChangeType string
+
+const (
+	NodeAdded       ChangeType = "node_added"
+	NodeRemoved     ChangeType = "node_removed"
+	NodeUpdated     ChangeType = "node_updated"
+	NodeUp          ChangeType = "node_up"
+	NodeDown        ChangeType = "node_down"
+	InstanceAdded   ChangeType = "instance_added"
+	InstanceRemoved ChangeType = "instance_removed"
+	InstanceUpdated ChangeType = "instance_updated"
+	InstanceMoved   ChangeType = "instance_moved"
+	DeviceReserved  ChangeType = "device_reserved"
+	DeviceReleased  ChangeType = "device_released"
+	AccessUpdated   ChangeType = "access_updated"
+	MappingsUpdated ChangeType = "mappings_updated"
+	USBReserved     ChangeType = "usb_reserved"
+	USBReleased     ChangeType = "usb_released"
+)
+
+// a single difference between the cached model and PVE that was applied during a sync
+type Change struct {
+	Type   ChangeType `json:"type"`
+	Node   string     `json:"node"`
+	VMID   InstanceID `json:"vmid,omitempty"`
+	From   string     `json:"from,omitempty"`   // previous node of a moved instance
+	Device DeviceBus  `json:"device,omitempty"` // reserved or released device, the port path of usb devices
+}
+
+// resources allocated to a set of instances
+type Usage struct {
+	Instances []InstanceID      `json:"instances"`
+	Cores     uint64            `json:"cores"`
+	Memory    uint64            `json:"memory"`
+	Swap      uint64            `json:"swap"`
+	Disk      map[string]uint64 `json:"disk"`    // bytes per storage
+	Network   uint64            `json:"network"` // sum of net rate limits
+	Devices   map[string]int    `json:"devices"` // assigned pci devices per device name
+}
+
+// summary of a single sync cycle
+type SyncStats struct {
+	lock       sync.Mutex
+	Started    time.Time     `json:"started"`
+	Duration   time.Duration `json:"duration"`
+	Mode       SyncMode      `json:"mode"`
+	Generation uint64        `json:"generation"`
+	Rebuilt    int           `json:"rebuilt"` // instances whose config was fetched and parsed
+	Skipped    int           `json:"skipped"` // instances whose config was fetched but had an unchanged digest
+	Reused     int           `json:"reused"`  // instances that were not fetched because their /cluster/resources state was unchanged
+	Changes    []Change      `json:"changes"`
+}
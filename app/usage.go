@@ -0,0 +1,85 @@
+package app
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// get the resources allocated to every instance in a pool
+func (snapshot *Snapshot) PoolUsage(poolName string) (*Usage, error) {
+	if _, ok := snapshot.Access.Pools[poolName]; !ok {
+		return nil, fmt.Errorf("pool %s not in cluster", poolName)
+	}
+	return snapshot.Usage(func(vmid InstanceID, instance *Instance) bool {
+		return instance.Pool == poolName
+	}), nil
+}
+
+// get the resources allocated to every instance a user owns, either directly or through a pool
+func (snapshot *Snapshot) UserUsage(userName string) (*Usage, error) {
+	user, ok := snapshot.Access.Users[userName]
+	if !ok {
+		return nil, fmt.Errorf("user %s not in cluster", userName)
+	}
+	owned := map[InstanceID]bool{}
+	for _, vmid := range user.Instances {
+		owned[vmid] = true
+	}
+	return snapshot.Usage(func(vmid InstanceID, instance *Instance) bool {
+		return owned[vmid] || slices.Contains(user.Pools, instance.Pool)
+	}), nil
+}
+
+// sums the resources allocated to each instance which matches
+func (snapshot *Snapshot) Usage(match func(InstanceID, *Instance) bool) *Usage {
+	usage := Usage{
+		Instances: []InstanceID{},
+		Disk:      make(map[string]uint64),
+		Devices:   make(map[string]int),
+	}
+
+	for _, vmid := range slices.Sorted(maps.Keys(snapshot.Index)) {
+		instance := snapshot.Nodes[snapshot.Index[vmid]].Instances[vmid]
+		if match(vmid, instance) {
+			usage.Add(vmid, instance)
+		}
+	}
+
+	return &usage
+}
+
+// adds the resources allocated to an instance
+func (usage *Usage) Add(vmid InstanceID, instance *Instance) {
+	usage.Instances = append(usage.Instances, vmid)
+	usage.Cores += instance.Cores
+	usage.Memory += instance.Memory
+	usage.Swap += instance.Swap
+	for _, volume := range instance.Volumes {
+		if volume.Storage != "" {
+			usage.Disk[volume.Storage] += volume.Size
+		}
+	}
+	for _, net := range instance.Nets {
+		usage.Network += net.Rate
+	}
+	for _, device := range instance.Devices {
+		usage.Devices[device.Device_Name]++
+	}
+}
+
+// adds the resources held by a pending reservation
+func (usage *Usage) AddReservation(reservation *Reservation) {
+	if reservation.VMID != 0 {
+		usage.Instances = append(usage.Instances, reservation.VMID)
+	}
+	usage.Cores += reservation.Cores
+	usage.Memory += reservation.Memory
+	usage.Swap += reservation.Swap
+	for storage, size := range reservation.Disk {
+		usage.Disk[storage] += size
+	}
+	for _, device := range reservation.Devices {
+		usage.Devices[device.Device_Name]++
+	}
+}
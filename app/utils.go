@@ -20,7 +20,23 @@ type Config struct {
 			Secret string `json:"uuid"`
 		}
 	}
-	ReloadInterval int `json:"rebuildInterval"`
+	ReloadInterval      int              `json:"rebuildInterval"`
+	SyncMode            SyncMode         `json:"syncMode"`
+	FullSyncEvery       int              `json:"fullSyncEvery"`       // in fast mode, every nth periodic sync is a full sync so that config only changes are picked up, 0 never forces a full sync
+	SyncConcurrency     int              `json:"syncConcurrency"`     // maximum concurrent requests to PVE across the cluster
+	SyncNodeConcurrency int              `json:"syncNodeConcurrency"` // maximum concurrent requests to PVE for a single node
+	TaskPollInterval    int              `json:"taskPollInterval"`    // seconds between polls of the PVE task log, 0 disables the task watcher
+	Webhooks            []WebhookConfig  `json:"webhooks"`
+	WebhookDeadLetter   string           `json:"webhookDeadLetter"` // path of the file that failed webhook deliveries are appended to
+	StatePath           string           `json:"statePath"`         // path of the file the model is saved to and loaded from at startup, empty disables saving
+	StateInterval       int              `json:"stateInterval"`     // seconds between saves of the model
+	HistoryPath         string           `json:"historyPath"`       // path of the append-only file every model change is recorded to, empty disables history
+	HistoryRetention    int              `json:"historyRetention"`  // seconds of history to keep, older records are compacted away
+	Quotas              QuotaConfig      `json:"quotas"`
+	Overcommit          OvercommitConfig `json:"overcommit"`
+	ReservationTTL      int              `json:"reservationTTL"`    // default seconds before a pending reservation expires
+	ReservationMaxTTL   int              `json:"reservationMaxTTL"` // maximum seconds a reservation can be requested for
+	VMIDs               VMIDConfig       `json:"vmids"`
 }
 
 func GetConfig(configPath string) Config {
@@ -33,6 +49,38 @@ func GetConfig(configPath string) Config {
 	if err != nil {
 		log.Fatal("Error during parsing config file: ", err)
 	}
+	if config.SyncMode == "" {
+		config.SyncMode = FullSync
+	} else if config.SyncMode != FastSync && config.SyncMode != FullSync {
+		log.Fatalf("Error during parsing config file: syncMode must be %s or %s", FastSync, FullSync)
+	}
+	if config.FullSyncEvery < 0 {
+		config.FullSyncEvery = 0
+	}
+	if config.SyncConcurrency <= 0 {
+		config.SyncConcurrency = 8
+	}
+	if config.SyncNodeConcurrency <= 0 {
+		config.SyncNodeConcurrency = 4
+	}
+	if config.StateInterval <= 0 {
+		config.StateInterval = 60
+	}
+	if config.HistoryRetention <= 0 {
+		config.HistoryRetention = 7 * 24 * 60 * 60
+	}
+	if config.ReservationTTL <= 0 {
+		config.ReservationTTL = 300
+	}
+	if config.VMIDs.Default.Min == 0 {
+		config.VMIDs.Default.Min = MinVMID
+	}
+	if config.VMIDs.Default.Max == 0 {
+		config.VMIDs.Default.Max = MaxVMID
+	}
+	if config.ReservationMaxTTL < config.ReservationTTL {
+		config.ReservationMaxTTL = max(3600, config.ReservationTTL)
+	}
 	return config
 }
 
@@ -45,6 +93,19 @@ func DeviceBusIDIsSuperDevice(BusID DeviceID) bool {
 	return !strings.ContainsRune(string(BusID), '.')
 }
 
+// adds the default pci domain to a bus id without one, PVE accepts hostpci ids such as 01:00.0 for 0000:01:00.0
+func NormalizeDeviceBusID(BusID DeviceID) DeviceID {
+	if strings.Count(string(BusID), ":") == 1 {
+		return "0000:" + BusID
+	}
+	return BusID
+}
+
+// lowercases a usb or pci id and strips any 0x prefix, eg: 0x046D to 046d
+func NormalizeHexID(id string) string {
+	return strings.TrimPrefix(strings.ToLower(id), "0x")
+}
+
 // checks if string s has one of any prefixes, and returns the prefix or "" if there was no match
 //
 // matches the first prefix match in array order
@@ -0,0 +1,168 @@
+package app
+
+import (
+	"context"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/luthermonson/go-proxmox"
+)
+
+// task types which change a single guest that stays on the same node
+var instanceTaskTypes = map[string]bool{
+	"qmconfig":    true,
+	"qmstart":     true,
+	"qmstop":      true,
+	"qmshutdown":  true,
+	"qmreboot":    true,
+	"qmreset":     true,
+	"qmsuspend":   true,
+	"qmresume":    true,
+	"qmpause":     true,
+	"qmtemplate":  true,
+	"qmmove":      true,
+	"vzstart":     true,
+	"vzstop":      true,
+	"vzshutdown":  true,
+	"vzreboot":    true,
+	"vzsuspend":   true,
+	"vzresume":    true,
+	"vztemplate":  true,
+	"move_volume": true,
+	"resize":      true,
+}
+
+// task types which add, remove or move guests, these rebuild the whole node which also follows migrated guests to their new node
+var hostTaskTypes = map[string]bool{
+	"qmcreate":  true,
+	"qmclone":   true,
+	"qmrestore": true,
+	"qmdestroy": true,
+	"qmigrate":  true,
+	"vzcreate":  true,
+	"vzclone":   true,
+	"vzrestore": true,
+	"vzdestroy": true,
+	"vzmigrate": true,
+	"hamigrate": true,
+}
+
+// how long finished tasks are remembered, nodes broadcast their task lists to /cluster/tasks with a delay,
+// so a task can show up after tasks of other nodes which ended later than it
+const TaskWindow = 10 * time.Minute
+
+// polls the PVE cluster task log and triggers targeted rebuilds for the guests and nodes changed by finished tasks
+type TaskWatcher struct {
+	jobs     *JobManager
+	pve      ProxmoxClient
+	interval time.Duration
+	cursor   time.Time                  // end time of the most recently ended task, zero until the first poll
+	handled  map[proxmox.UPID]time.Time // end time of each task handled within the window before the cursor
+}
+
+type instanceTarget struct {
+	node string
+	vmid uint
+}
+
+func NewTaskWatcher(jobs *JobManager, pve ProxmoxClient, interval time.Duration) *TaskWatcher {
+	return &TaskWatcher{
+		jobs:     jobs,
+		pve:      pve,
+		interval: interval,
+		handled:  make(map[proxmox.UPID]time.Time),
+	}
+}
+
+// polls the task log every interval until ctx is cancelled, each poll is cancelled if it takes longer than the interval
+func (watcher *TaskWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(watcher.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pollctx, cancel := context.WithTimeout(ctx, watcher.interval)
+			err := watcher.Poll(pollctx)
+			cancel()
+			if err != nil {
+				log.Printf("Failed to poll cluster tasks: %s", err.Error())
+			}
+		}
+	}
+}
+
+// fetches the task log and starts sync jobs for everything changed by tasks which finished since the last poll
+//
+// the first poll only moves the cursor to the newest finished task so that old tasks are not replayed on startup
+func (watcher *TaskWatcher) Poll(ctx context.Context) error {
+	tasks, err := watcher.pve.Tasks(ctx)
+	if err != nil {
+		return err
+	}
+
+	first := watcher.cursor.IsZero()
+	finished := watcher.Advance(tasks)
+	if first {
+		if watcher.cursor.IsZero() { // no finished tasks yet, every task seen from now on is new
+			watcher.cursor = time.Unix(0, 0)
+		}
+		return nil
+	}
+
+	hosts := map[string]bool{}
+	instances := map[instanceTarget]bool{}
+	for _, task := range finished {
+		if hostTaskTypes[task.Type] {
+			hosts[task.Node] = true
+		} else if vmid, err := strconv.ParseUint(task.ID, 10, 64); instanceTaskTypes[task.Type] && err == nil {
+			instances[instanceTarget{node: task.Node, vmid: uint(vmid)}] = true
+		}
+	}
+
+	for _, hostName := range slices.Sorted(maps.Keys(hosts)) {
+		watcher.jobs.SyncHost(hostName)
+	}
+
+	for target := range instances {
+		if hosts[target.node] { // already rebuilt with the rest of the node
+			continue
+		}
+		watcher.jobs.SyncInstance(target.node, target.vmid)
+	}
+
+	return nil
+}
+
+// moves the cursor to the newest finished task and returns the finished tasks which were not handled by a previous call
+//
+// tasks are tracked by upid within TaskWindow before the cursor, tasks which ended before the window are ignored
+func (watcher *TaskWatcher) Advance(tasks proxmox.Tasks) []*proxmox.Task {
+	finished := []*proxmox.Task{}
+	for _, task := range tasks {
+		if task.EndTime.IsZero() { // still running
+			continue
+		}
+		if _, ok := watcher.handled[task.UPID]; ok || task.EndTime.Before(watcher.cursor.Add(-TaskWindow)) {
+			continue
+		}
+		finished = append(finished, task)
+		watcher.handled[task.UPID] = task.EndTime
+		if task.EndTime.After(watcher.cursor) {
+			watcher.cursor = task.EndTime
+		}
+	}
+
+	// forget tasks which ended before the window, they are ignored from now on
+	for upid, endTime := range watcher.handled {
+		if endTime.Before(watcher.cursor.Add(-TaskWindow)) {
+			delete(watcher.handled, upid)
+		}
+	}
+
+	return finished
+}
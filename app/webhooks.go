@@ -0,0 +1,218 @@
+package app
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const WebhookDefaultRetries = 5
+const WebhookDefaultTimeout = 10 // seconds
+const WebhookBaseBackoff = time.Second
+const WebhookMaxBackoff = 5 * time.Minute
+
+// events queued for a single target before new events are sent straight to the dead letter log
+const WebhookQueueSize = 10000
+
+type WebhookConfig struct {
+	Name    string       `json:"name"`
+	URL     string       `json:"url"`
+	Events  []ChangeType `json:"events"`  // event types sent to the target, empty sends every type
+	Secret  string       `json:"secret"`  // key used to sign each body with HMAC-SHA256, empty disables signing
+	Retries int          `json:"retries"` // attempts after the first failed delivery
+	Timeout int          `json:"timeout"` // seconds before a delivery attempt is abandoned
+}
+
+// a failed delivery as written to the dead letter log
+type DeadLetter struct {
+	Time     time.Time `json:"time"`
+	Target   string    `json:"target"`
+	URL      string    `json:"url"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Event    Event     `json:"event"`
+}
+
+// delivers model change events to the configured webhook targets
+type WebhookDispatcher struct {
+	targets    []*webhookTarget
+	deadLetter string
+	lock       sync.Mutex // serializes writes to the dead letter log
+}
+
+// a single target with its own queue so that a slow or failing target does not delay the others
+type webhookTarget struct {
+	config     WebhookConfig
+	client     http.Client
+	dispatcher *WebhookDispatcher
+	lock       sync.Mutex
+	queue      []Event
+	signal     chan struct{}
+}
+
+func NewWebhookDispatcher(configs []WebhookConfig, deadLetter string) *WebhookDispatcher {
+	dispatcher := WebhookDispatcher{deadLetter: deadLetter}
+	for _, config := range configs {
+		if config.Name == "" {
+			config.Name = config.URL
+		}
+		if config.Retries <= 0 {
+			config.Retries = WebhookDefaultRetries
+		}
+		if config.Timeout <= 0 {
+			config.Timeout = WebhookDefaultTimeout
+		}
+		target := &webhookTarget{
+			config:     config,
+			client:     http.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+			dispatcher: &dispatcher,
+			queue:      []Event{},
+			signal:     make(chan struct{}, 1),
+		}
+		dispatcher.targets = append(dispatcher.targets, target)
+		go target.run()
+	}
+	return &dispatcher
+}
+
+// queues an event for every target whose filter accepts it, never blocks
+func (dispatcher *WebhookDispatcher) Enqueue(event Event) {
+	for _, target := range dispatcher.targets {
+		if len(target.config.Events) > 0 && !slices.Contains(target.config.Events, event.Type) {
+			continue
+		}
+
+		target.lock.Lock()
+		full := len(target.queue) >= WebhookQueueSize
+		if !full {
+			target.queue = append(target.queue, event)
+		}
+		target.lock.Unlock()
+
+		if full {
+			dispatcher.DeadLetter(target.config, event, 0, fmt.Errorf("queue is full"))
+			continue
+		}
+
+		select {
+		case target.signal <- struct{}{}:
+		default: // target has already been signalled
+		}
+	}
+}
+
+// appends a failed delivery to the dead letter log, or only logs it if no dead letter log is configured
+func (dispatcher *WebhookDispatcher) DeadLetter(config WebhookConfig, event Event, attempts int, err error) {
+	log.Printf("Failed to deliver event %d to webhook %s after %d attempts: %s", event.ID, config.Name, attempts, err.Error())
+	if dispatcher.deadLetter == "" {
+		return
+	}
+
+	content, _ := json.Marshal(DeadLetter{
+		Time:     time.Now(),
+		Target:   config.Name,
+		URL:      config.URL,
+		Attempts: attempts,
+		Error:    err.Error(),
+		Event:    event,
+	})
+
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+
+	file, ferr := os.OpenFile(dispatcher.deadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if ferr != nil {
+		log.Printf("Failed to open webhook dead letter log %s: %s", dispatcher.deadLetter, ferr.Error())
+		return
+	}
+	defer file.Close()
+	file.Write(append(content, '\n'))
+}
+
+// delivers queued events in order, one at a time
+func (target *webhookTarget) run() {
+	for range target.signal {
+		for {
+			target.lock.Lock()
+			if len(target.queue) == 0 {
+				target.lock.Unlock()
+				break
+			}
+			event := target.queue[0]
+			target.queue = target.queue[1:]
+			target.lock.Unlock()
+
+			target.deliver(event)
+		}
+	}
+}
+
+// posts an event to the target, retrying with exponential backoff until it succeeds, fails permanently or runs out of retries
+func (target *webhookTarget) deliver(event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		target.dispatcher.DeadLetter(target.config, event, 0, err)
+		return
+	}
+
+	backoff := WebhookBaseBackoff
+	attempts := 0
+	for {
+		attempts++
+		retry, err := target.post(event, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempts > target.config.Retries {
+			target.dispatcher.DeadLetter(target.config, event, attempts, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, WebhookMaxBackoff)
+	}
+}
+
+// makes a single delivery attempt, returns whether a failed attempt should be retried
+func (target *webhookTarget) post(event Event, body []byte) (bool, error) {
+	request, err := http.NewRequest(http.MethodPost, target.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Fabric-Event", string(event.Type))
+	request.Header.Set("X-Fabric-Delivery", strconv.FormatUint(event.ID, 10))
+	if target.config.Secret != "" {
+		request.Header.Set("X-Fabric-Signature", "sha256="+SignWebhook(target.config.Secret, body))
+	}
+
+	response, err := target.client.Do(request)
+	if err != nil { // network errors and timeouts are retried
+		return true, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("target responded with %s", response.Status)
+	// client errors other than timeouts and rate limits will fail again, so they are not retried
+	retry := response.StatusCode >= 500 || response.StatusCode == http.StatusRequestTimeout || response.StatusCode == http.StatusTooManyRequests
+	return retry, err
+}
+
+// get the hex encoded HMAC-SHA256 of a body
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}